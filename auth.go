@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/xbsoftware/wfs"
+)
+
+type CurrentUser struct {
+	ID    int
+	Root  int
+	Drive wfs.Drive
+}
+
+type contextKey int
+
+const userKey contextKey = iota
+
+const sessionCookie = "session"
+
+const sessionLifetime = 7 * 24 * time.Hour
+
+// tree of the first user, demo data is imported there
+const defaultRoot = 1
+
+var errNotAuthenticated = errors.New("Not authenticated")
+
+// AuthProvider resolves the id of the user who made the request
+// it must return 0 for anonymous requests and errNotAuthenticated for invalid credentials
+type AuthProvider func(r *http.Request) (int, error)
+
+// authProvider can be replaced to integrate with an external identity service
+var authProvider AuthProvider = sessionAuth
+
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid, err := authProvider(r)
+		if err == errNotAuthenticated {
+			format.Text(w, 401, err.Error())
+			return
+		}
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		// requests without credentials act as the demo user, if it is configured
+		if uid == 0 {
+			uid = Config.DemoUser
+		}
+		if uid == 0 {
+			format.Text(w, 401, errNotAuthenticated.Error())
+			return
+		}
+
+		root, err := getUserRoot(uid)
+		if err == sql.ErrNoRows {
+			format.Text(w, 401, errNotAuthenticated.Error())
+			return
+		}
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		user := &CurrentUser{ID: uid, Root: root}
+		user.Drive = getDrive(user)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, user)))
+	})
+}
+
+// getUser returns the user resolved by authMiddleware
+func getUser(r *http.Request) *CurrentUser {
+	return r.Context().Value(userKey).(*CurrentUser)
+}
+
+// sessionAuth checks a session token from the Authorization header or from the session cookie
+func sessionAuth(r *http.Request) (int, error) {
+	token := ""
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimSpace(header[7:])
+	} else if cookie, err := r.Cookie(sessionCookie); err == nil {
+		token = cookie.Value
+	}
+
+	if token == "" {
+		return 0, nil
+	}
+
+	var uid int
+	err := conn.Get(&uid, "SELECT user_id FROM session WHERE token = ? AND expires > now()", token)
+	if err == sql.ErrNoRows {
+		return 0, errNotAuthenticated
+	}
+
+	return uid, err
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func addAuthRoutes(r chi.Router) {
+	// demo login, allows to switch between users without a password
+	// real deployments are expected to issue sessions through their own AuthProvider
+	if Config.DemoUser != 0 {
+		r.Post("/login", demoLogin)
+	}
+
+	r.Post("/logout", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			conn.Exec("DELETE FROM session WHERE token = ?", cookie.Value)
+		}
+		header := r.Header.Get("Authorization")
+		if strings.HasPrefix(header, "Bearer ") {
+			conn.Exec("DELETE FROM session WHERE token = ?", strings.TrimSpace(header[7:]))
+		}
+
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+		format.JSON(w, 200, Response{})
+	})
+}
+
+// demoLogin opens a session for the user with the id, without a password
+func demoLogin(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	uid := 0
+	conn.Get(&uid, "SELECT id FROM user WHERE id = ?", r.Form.Get("id"))
+	if uid == 0 {
+		format.Text(w, 500, "wrong user id")
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		format.Text(w, 500, err.Error())
+		return
+	}
+
+	expires := time.Now().Add(sessionLifetime)
+	_, err = conn.Exec("INSERT INTO session(token, user_id, expires) VALUES(?, ?, ?)", token, uid, expires)
+	if err != nil {
+		format.Text(w, 500, err.Error())
+		return
+	}
+	conn.Exec("DELETE FROM session WHERE expires <= now()")
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	format.JSON(w, 200, Response{ID: token})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// content of files is stored by its sha256 hash, so identical files are stored only once
+// refs is the number of files and versions which use the blob
+
+// prevents removal of a blob while the same content is being saved
+var blobsLock sync.Mutex
+
+// saveBlob stores the data and adds a reference to its blob
+func saveBlob(folder string, data io.Reader) (string, int64, error) {
+	file, err := ioutil.TempFile(folder, "c")
+	if err != nil {
+		return "", 0, errors.New("Can't open file for writing")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), data)
+	if err != nil {
+		return "", 0, errors.New("Can't write data")
+	}
+	file.Close()
+	name := hex.EncodeToString(hash.Sum(nil))
+
+	blobsLock.Lock()
+	defer blobsLock.Unlock()
+
+	if _, err = os.Stat(filepath.Join(folder, name)); os.IsNotExist(err) {
+		err = os.Rename(file.Name(), filepath.Join(folder, name))
+		if err != nil {
+			return "", 0, errors.New("Can't write data")
+		}
+	}
+
+	_, err = conn.Exec("INSERT INTO content_blob(hash, size, refs) VALUES(?, ?, 1) ON DUPLICATE KEY UPDATE refs = refs + 1", name, size)
+	return name, size, err
+}
+
+// addBlobRef adds a reference to the existing blob
+// the row of the blob is locked, so it can't be removed till the end of the transaction
+func addBlobRef(tx *sqlx.Tx, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	refs := 0
+	err := tx.Get(&refs, "SELECT refs FROM content_blob WHERE hash = ? FOR UPDATE", name)
+	if err == sql.ErrNoRows {
+		return errors.New("content of the file is missing")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE content_blob SET refs = refs + 1 WHERE hash = ?", name)
+	return err
+}
+
+// releaseBlob removes a reference to the blob, unused blobs are deleted from the disk
+func releaseBlob(name string) {
+	if name == "" {
+		return
+	}
+
+	blobsLock.Lock()
+	defer blobsLock.Unlock()
+
+	_, err := conn.Exec("UPDATE content_blob SET refs = refs - 1 WHERE hash = ? AND refs > 0", name)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	removeUnusedBlob(name)
+}
+
+// removeUnusedBlob deletes the blob without references, blobsLock must be held
+func removeUnusedBlob(name string) {
+	res, err := conn.Exec("DELETE FROM content_blob WHERE hash = ? AND refs = 0", name)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return
+	}
+
+	err = os.Remove(filepath.Join(Config.DataFolder, name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	removePreviews(name)
+}
+
+// migrateBlobs moves content files of older versions of the app to the blob storage
+func migrateBlobs() {
+	// history events of older versions of the app referenced blobs
+	unused := make([]string, 0)
+	conn.Select(&unused, "SELECT hash FROM content_blob WHERE refs = 0")
+	for _, name := range unused {
+		blobsLock.Lock()
+		removeUnusedBlob(name)
+		blobsLock.Unlock()
+	}
+
+	names := make([]string, 0)
+	err := conn.Select(&names, `SELECT content FROM entity WHERE content != ''
+		UNION SELECT content FROM entity_edit WHERE content != ''
+		UNION SELECT previous FROM entity_edit WHERE previous != ''`)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	count := 0
+	for _, name := range names {
+		if len(name) == sha256.Size*2 {
+			continue
+		}
+
+		path := filepath.Join(Config.DataFolder, name)
+		file, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		blob := hex.EncodeToString(hash.Sum(nil))
+		if _, err = os.Stat(filepath.Join(Config.DataFolder, blob)); os.IsNotExist(err) {
+			err = os.Rename(path, filepath.Join(Config.DataFolder, blob))
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		conn.Exec("UPDATE entity SET content = ? WHERE content = ?", blob, name)
+		conn.Exec("UPDATE entity_edit SET content = ? WHERE content = ?", blob, name)
+		conn.Exec("UPDATE entity_edit SET previous = ? WHERE previous = ?", blob, name)
+		count++
+	}
+
+	if count == 0 {
+		return
+	}
+
+	// references are counted from scratch
+	_, err = conn.Exec(`INSERT IGNORE INTO content_blob(hash, size, refs)
+		SELECT content, 0, 0 FROM entity WHERE content != ''
+		UNION SELECT content, 0, 0 FROM entity_edit WHERE content != ''`)
+	if err == nil {
+		_, err = conn.Exec(`UPDATE content_blob SET
+			refs = (SELECT count(*) FROM entity WHERE content = hash) + (SELECT count(*) FROM entity_edit WHERE content = hash)`)
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	blobs := make([]string, 0)
+	conn.Select(&blobs, "SELECT hash FROM content_blob WHERE size = 0")
+	for _, name := range blobs {
+		if info, err := os.Stat(filepath.Join(Config.DataFolder, name)); err == nil {
+			conn.Exec("UPDATE content_blob SET size = ? WHERE hash = ?", info.Size(), name)
+		}
+	}
+
+	log.Printf("Moved %d files to the blob storage", count)
+}
+
+// getUsage returns the size of all files and versions of the tree
+// and the size of unique blobs which are used by them
+func getUsage(tree int) (uint64, uint64, error) {
+	var usage struct {
+		Logical  uint64
+		Physical uint64
+	}
+
+	err := conn.Get(&usage, `SELECT
+		(SELECT COALESCE(sum(size), 0) FROM entity WHERE tree = ?) +
+		(SELECT COALESCE(sum(content_blob.size), 0) FROM entity_edit
+			INNER JOIN entity ON entity.id = entity_edit.entity_id
+			INNER JOIN content_blob ON content_blob.hash = entity_edit.content
+			WHERE entity.tree = ?) AS logical,
+		(SELECT COALESCE(sum(size), 0) FROM content_blob WHERE hash IN (
+			SELECT content FROM entity WHERE tree = ?
+			UNION SELECT entity_edit.content FROM entity_edit
+				INNER JOIN entity ON entity.id = entity_edit.entity_id WHERE entity.tree = ?)) AS physical`,
+		tree, tree, tree, tree)
+
+	return usage.Logical, usage.Physical, err
+}
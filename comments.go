@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+)
+
+type CommentInfo struct {
+	ID           int        `json:"id"`
+	Content      string     `json:"text"`
+	Modified     time.Time  `json:"date"`
+	UserId       int        `db:"user_id" json:"user_id"`
+	ParentID     int        `db:"parent_id" json:"parent_id"`
+	Resolved     bool       `json:"resolved"`
+	ResolvedBy   int        `db:"resolved_by" json:"resolved_by,omitempty"`
+	ResolvedDate *time.Time `db:"resolved_date" json:"resolved_date,omitempty"`
+	Mentions     []int      `db:"-" json:"mentions,omitempty"`
+	Edited       *time.Time `json:"edited,omitempty"`
+	Deleted      *time.Time `json:"deleted,omitempty"`
+	DeletedBy    int        `db:"deleted_by" json:"deleted_by,omitempty"`
+	// optional anchor to the range of text in the version of the file
+	Version int    `db:"edit_id" json:"version,omitempty"`
+	Unit    string `db:"anchor_unit" json:"unit,omitempty"`
+	From    *int   `db:"anchor_from" json:"from,omitempty"`
+	To      *int   `db:"anchor_to" json:"to,omitempty"`
+}
+
+// CommentRevision is a stored state of the comment, removal is stored as a revision as well
+type CommentRevision struct {
+	ID       int       `json:"id"`
+	Content  string    `json:"text"`
+	UserId   int       `db:"user_id" json:"user_id"`
+	Deleted  bool      `json:"deleted"`
+	Modified time.Time `json:"date"`
+}
+
+// VersionText is the text of the version with comments anchored to it
+type VersionText struct {
+	HTML     string        `json:"html"`
+	Comments []CommentInfo `json:"comments"`
+}
+
+type MentionInfo struct {
+	ID        int       `json:"id"`
+	CommentID int       `db:"comment_id" json:"comment_id"`
+	EntityID  int       `db:"entity_id" json:"-"`
+	FileID    string    `db:"-" json:"file"`
+	Name      string    `json:"name"`
+	Content   string    `json:"text"`
+	Modified  time.Time `json:"date"`
+	UserId    int       `db:"user_id" json:"user_id"`
+	Tree      int       `json:"-"`
+	Path      string    `json:"-"`
+}
+
+// content of removed comments is replaced by the tombstone
+const commentFields = `id, user_id, modified, parent_id, resolved, resolved_by, resolved_date,
+	edit_id, anchor_unit, anchor_from, anchor_to, edited, deleted, deleted_by,
+	IF(deleted IS NULL, COALESCE(content, ''),
+		concat('comment removed by ', COALESCE((SELECT name FROM user WHERE user.id = deleted_by), ''))) AS content`
+
+// @email or @name, where name is the part of the email before @
+var mentionRegexp = regexp.MustCompile(`(?:^|[^\w.])@([\w.+-]+(?:@[\w-]+(?:\.[\w-]+)+)?)`)
+
+func addCommentRoutes(r chi.Router) {
+	r.Get("/comments", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		id := r.URL.Query().Get("id")
+		did := dbID(id, user)
+		if !hasAccess(user, did, ViewerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		comments := make([]CommentInfo, 0)
+		err := conn.Select(&comments, "select "+commentFields+" from comment where entity_id = ? order by id", did)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+		addMentions(comments)
+
+		// the user has seen all mentions of the document
+		conn.Exec("update comment_mention set is_read = 1 where entity_id = ? and user_id = ?", did, user.ID)
+
+		format.JSON(w, 200, comments)
+	})
+
+	r.Post("/comments", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		r.ParseForm()
+		id := r.URL.Query().Get("id")
+		did := dbID(id, user)
+		if !hasAccess(user, did, CommenterAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+		content := r.Form.Get("value")
+
+		// replies are attached to the first comment of the thread
+		parent := 0
+		if pid := r.Form.Get("parent"); pid != "" && pid != "0" {
+			var p struct {
+				ID       int
+				EntityID int `db:"entity_id"`
+				ParentID int `db:"parent_id"`
+			}
+			conn.Get(&p, "select id, entity_id, parent_id from comment where id = ?", pid)
+			if p.ID == 0 || p.EntityID != did {
+				format.JSON(w, 500, Response{Invalid: true, Error: "wrong parent comment"})
+				return
+			}
+
+			parent = p.ID
+			if p.ParentID != 0 {
+				parent = p.ParentID
+			}
+		}
+
+		anchor, err := getAnchor(r, did)
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
+		}
+
+		res, err := conn.Exec("insert into comment(entity_id, user_id, content, parent_id, edit_id, anchor_unit, anchor_from, anchor_to)  values(?, ?, ?, ?, ?, ?, ?, ?)",
+			did, user.ID, content, parent, anchor.Version, anchor.Unit, anchor.From, anchor.To)
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
+		}
+		cid, _ := res.LastInsertId()
+		saveRevision(int(cid), user, content, false)
+		saveMentions(int(cid), did, user, content)
+
+		format.JSON(w, 200, Response{ID: strconv.FormatInt(cid, 10)})
+	})
+
+	r.Put("/comments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		r.ParseForm()
+		id := chi.URLParam(r, "id")
+		content := r.Form.Get("value")
+
+		var c struct {
+			UserID   int `db:"user_id"`
+			EntityID int `db:"entity_id"`
+		}
+		conn.Get(&c, "select user_id, entity_id from comment where id = ? and deleted is null", id)
+		if c.UserID != user.ID || !hasAccess(user, c.EntityID, CommenterAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		conn.Exec("update comment SET content = ?, edited = ? WHERE id = ?", content, time.Now(), id)
+		cid, _ := strconv.Atoi(id)
+		saveRevision(cid, user, content, false)
+		saveMentions(cid, c.EntityID, user, content)
+
+		format.JSON(w, 200, Response{ID: id})
+	})
+
+	r.Put("/comments/{id}/resolve", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		r.ParseForm()
+		id := chi.URLParam(r, "id")
+
+		var c struct {
+			EntityID int `db:"entity_id"`
+			ParentID int `db:"parent_id"`
+		}
+		err := conn.Get(&c, "select entity_id, parent_id from comment where id = ?", id)
+		if err != nil || !hasAccess(user, c.EntityID, CommenterAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+		if c.ParentID != 0 {
+			format.JSON(w, 500, Response{Invalid: true, Error: "only the first comment of the thread can be resolved"})
+			return
+		}
+
+		if isNo(r.Form.Get("resolved")) {
+			_, err = conn.Exec("update comment SET resolved = 0, resolved_by = 0, resolved_date = NULL WHERE id = ?", id)
+		} else {
+			_, err = conn.Exec("update comment SET resolved = 1, resolved_by = ?, resolved_date = ? WHERE id = ?", user.ID, time.Now(), id)
+		}
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
+		}
+
+		format.JSON(w, 200, Response{ID: id})
+	})
+
+	r.Delete("/comments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		id := chi.URLParam(r, "id")
+
+		var c struct {
+			UserID   int `db:"user_id"`
+			EntityID int `db:"entity_id"`
+		}
+		conn.Get(&c, "select user_id, entity_id from comment where id = ? and deleted is null", id)
+		if c.UserID != user.ID || !hasAccess(user, c.EntityID, CommenterAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		// the comment is replaced by the tombstone, replies are preserved
+		// the removed text is still available in the revision history
+		conn.Exec("update comment SET content = NULL, deleted = ?, deleted_by = ? WHERE id = ?", time.Now(), user.ID, id)
+		cid, _ := strconv.Atoi(id)
+		saveRevision(cid, user, "", true)
+		conn.Exec("delete from comment_mention WHERE comment_id = ?", id)
+
+		format.JSON(w, 200, Response{ID: id})
+	})
+
+	r.Get("/comments/{id}/revisions", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		id := chi.URLParam(r, "id")
+
+		var did int
+		conn.Get(&did, "select entity_id from comment where id = ?", id)
+		if !hasAccess(user, did, ViewerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		comment := CommentInfo{}
+		err := conn.Get(&comment, "select "+commentFields+" from comment where id = ?", id)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		// text of the removed comment is available only to its author and to the owner of the document
+		if comment.Deleted != nil && comment.UserId != user.ID && !hasAccess(user, did, OwnerAccess) {
+			tombstone := CommentRevision{ID: comment.ID, Content: comment.Content, UserId: comment.DeletedBy, Deleted: true, Modified: *comment.Deleted}
+			format.JSON(w, 200, []CommentRevision{tombstone})
+			return
+		}
+
+		revisions := make([]CommentRevision, 0)
+		err = conn.Select(&revisions, "select id, COALESCE(content, '') AS content, user_id, deleted, modified from comment_revision where comment_id = ? order by id", id)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		format.JSON(w, 200, revisions)
+	})
+
+	r.Get("/mentions", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+
+		mentions := make([]MentionInfo, 0)
+		err := conn.Select(&mentions, `select comment_mention.id, comment_id, comment_mention.entity_id,
+			entity.name, entity.tree, entity.path, comment.content, comment.modified, comment.user_id
+			from comment_mention
+			inner join comment on comment.id = comment_mention.comment_id
+			inner join entity on entity.id = comment_mention.entity_id
+			where comment_mention.user_id = ? and is_read = 0 and left(entity.path, 1) != "."
+			order by comment.modified desc`, user.ID)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		// the access to the document could be revoked after the mention
+		out := make([]MentionInfo, 0, len(mentions))
+		for _, m := range mentions {
+			if getAccessLevel(m.EntityID, m.Tree, m.Path, user.ID, user.Root) >= ViewerAccess {
+				m.FileID = clientID(m.Tree, m.Path, user.Root)
+				out = append(out, m)
+			}
+		}
+
+		format.JSON(w, 200, out)
+	})
+
+	r.Put("/mentions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		id := chi.URLParam(r, "id")
+
+		conn.Exec("update comment_mention set is_read = 1 where id = ? and user_id = ?", id, user.ID)
+		format.JSON(w, 200, Response{ID: id})
+	})
+}
+
+var anchorUnits = map[string]bool{"char": true, "line": true}
+
+// getAnchor reads the anchor of the new comment from the request
+// a range without version is anchored to the last version of the file
+func getAnchor(r *http.Request, did int) (CommentInfo, error) {
+	anchor := CommentInfo{}
+	version := r.Form.Get("version")
+	from := r.Form.Get("from")
+	to := r.Form.Get("to")
+
+	if version != "" {
+		err := conn.Get(&anchor.Version, "SELECT id FROM entity_edit WHERE id = ? AND entity_id = ?", version, did)
+		if err != nil {
+			return anchor, errors.New("wrong version of the file")
+		}
+	}
+	if from == "" && to == "" {
+		return anchor, nil
+	}
+
+	start, err := strconv.Atoi(from)
+	if err != nil || start < 0 {
+		return anchor, errors.New("incorrect from value")
+	}
+	end, err := strconv.Atoi(to)
+	if err != nil || end < start {
+		return anchor, errors.New("incorrect to value")
+	}
+
+	anchor.Unit = r.Form.Get("unit")
+	if anchor.Unit == "" {
+		anchor.Unit = "char"
+	}
+	if !anchorUnits[anchor.Unit] {
+		return anchor, errors.New("incorrect unit value")
+	}
+
+	if anchor.Version == 0 {
+		err = conn.Get(&anchor.Version, "SELECT id FROM entity_edit WHERE entity_id = ? AND content != '' ORDER BY modified desc, id desc LIMIT 1", did)
+		if err != nil {
+			return anchor, errors.New("the file has no versions")
+		}
+	}
+
+	anchor.From = &start
+	anchor.To = &end
+	return anchor, nil
+}
+
+// getVersionComments returns comments anchored to the version
+func getVersionComments(version string) ([]CommentInfo, error) {
+	comments := make([]CommentInfo, 0)
+	err := conn.Select(&comments, "select "+commentFields+" from comment where edit_id = ? order by anchor_from, id", version)
+	if err != nil {
+		return nil, err
+	}
+	addMentions(comments)
+
+	return comments, nil
+}
+
+// saveRevision adds the new state of the comment to its history
+func saveRevision(cid int, user *CurrentUser, content string, deleted bool) {
+	_, err := conn.Exec("INSERT INTO comment_revision(comment_id, user_id, content, deleted, modified) VALUES(?, ?, ?, ?, ?)",
+		cid, user.ID, content, deleted, time.Now())
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
+
+// saveMentions stores mentioned users of the comment
+// only users with access to the document can be mentioned
+func saveMentions(cid, did int, author *CurrentUser, content string) {
+	var info struct {
+		Tree int
+		Path string
+	}
+	conn.Get(&info, "SELECT tree, path FROM entity WHERE id = ?", did)
+
+	uids := make([]int, 0)
+	for _, m := range mentionRegexp.FindAllStringSubmatch(content, -1) {
+		name := strings.TrimRight(m[1], ".")
+
+		var u struct {
+			ID   int
+			Root int
+		}
+		err := conn.Get(&u, "SELECT id, root FROM user WHERE email = ? OR SUBSTRING_INDEX(email, '@', 1) = ? ORDER BY id LIMIT 1", name, name)
+		if err != nil || u.ID == author.ID {
+			continue
+		}
+		if getAccessLevel(did, info.Tree, info.Path, u.ID, u.Root) >= ViewerAccess {
+			uids = append(uids, u.ID)
+		}
+	}
+
+	// keep read state of mentions which are still present after editing
+	if len(uids) == 0 {
+		conn.Exec("DELETE FROM comment_mention WHERE comment_id = ?", cid)
+		return
+	}
+	query, args, _ := sqlx.In("DELETE FROM comment_mention WHERE comment_id = ? AND user_id NOT IN (?)", cid, uids)
+	conn.Exec(query, args...)
+
+	for _, uid := range uids {
+		conn.Exec(`INSERT INTO comment_mention(comment_id, entity_id, user_id)
+			SELECT ?, ?, ? FROM DUAL WHERE NOT EXISTS (
+				SELECT id FROM comment_mention WHERE comment_id = ? AND user_id = ?)`, cid, did, uid, cid, uid)
+	}
+}
+
+// addMentions adds ids of mentioned users to the comments
+func addMentions(comments []CommentInfo) {
+	if len(comments) == 0 {
+		return
+	}
+
+	temp := make(map[int]*CommentInfo)
+	ids := make([]int, len(comments))
+	for i := range comments {
+		ids[i] = comments[i].ID
+		temp[comments[i].ID] = &comments[i]
+	}
+
+	mentions := make([]struct {
+		CommentID int `db:"comment_id"`
+		UserID    int `db:"user_id"`
+	}, 0)
+	query, args, _ := sqlx.In("SELECT comment_id, user_id FROM comment_mention WHERE comment_id IN (?)", ids)
+	conn.Select(&mentions, query, args...)
+
+	for _, m := range mentions {
+		c := temp[m.CommentID]
+		c.Mentions = append(c.Mentions, m.UserID)
+	}
+}
@@ -2,8 +2,10 @@ package demodata
 
 import (
 	"database/sql"
+	"encoding/hex"
 	"github.com/jmoiron/sqlx"
 	"github.com/xbsoftware/wfs"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -20,20 +22,51 @@ func nonError(e error) {
 	}
 }
 
-func ResetDemoData(drive wfs.Drive, db *sqlx.DB) {
+func ResetDemoData(drive wfs.Drive, db *sqlx.DB, dataFolder string) {
 	must(db.Exec("truncate table entity"))
 	must(db.Exec("truncate table entity_edit"))
+	must(db.Exec("truncate table content_blob"))
 	must(db.Exec("truncate table entity_tag"))
 	must(db.Exec("truncate table entity_user"))
+	must(db.Exec("truncate table share_link"))
+	must(db.Exec("truncate table entity_text"))
+	must(db.Exec("truncate table access_log"))
+	must(db.Exec("truncate table saved_search"))
+	must(db.Exec("truncate table session"))
 
 	must(db.Exec("truncate table comment"))
+	must(db.Exec("truncate table comment_mention"))
+	must(db.Exec("truncate table comment_revision"))
 	must(db.Exec("truncate table favorite"))
 	must(db.Exec("truncate table tag"))
 	must(db.Exec("truncate table user"))
+	removeBlobs(dataFolder)
 
 	ImportDemoData(drive, db)
 }
 
+// removeBlobs deletes content files, which are not referenced after truncating of content_blob
+// blobs are named by the sha256 of the content, other files of the folder are kept
+func removeBlobs(folder string) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() || len(f.Name()) != 64 {
+			continue
+		}
+		if _, err := hex.DecodeString(f.Name()); err != nil {
+			continue
+		}
+		nonError(os.Remove(filepath.Join(folder, f.Name())))
+	}
+}
+
 func ImportDemoData(drive wfs.Drive, db *sqlx.DB) {
 	tcount := struct{ Count int }{}
 	must(nil, db.Get(&tcount, "select count(entity.id) as count from entity"))
@@ -54,7 +87,7 @@ func importDemoTags(db *sqlx.DB) {
 }
 
 func importDemoUsers(db *sqlx.DB) {
-	must(db.Exec("INSERT INTO user (id, email, name, avatar) VALUES (1, 'alastor@ya.ru', 'Alastor Moody', '/users/1/avatar/1.jpg')"))
+	must(db.Exec("INSERT INTO user (id, email, name, avatar, root) VALUES (1, 'alastor@ya.ru', 'Alastor Moody', '/users/1/avatar/1.jpg', 1)"))
 	must(db.Exec("INSERT INTO user (id, email, name, avatar) VALUES (2, 'johndawlish@gmail.com', 'John Dawlish', '/users/2/avatar/2.jpg')"))
 	must(db.Exec("INSERT INTO user (id, email, name, avatar) VALUES (3, 'sirius@gmail.com', 'Sirius Black', '/users/3/avatar/3.jpg')"))
 	must(db.Exec("INSERT INTO user (id, email, name, avatar) VALUES (4, 'nymphadora@gmail.com', 'Nymphadora Tonks', '/users/4/avatar/4.jpg')"))
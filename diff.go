@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"html"
 	"strings"
+	"unicode"
 
 	diffLib "github.com/sergi/go-diff/diffmatchpatch"
 )
@@ -14,10 +16,116 @@ func init() {
 	replacer = strings.NewReplacer("\r", "", "\n", "&#8626;<br>")
 }
 
+// granularity of the diff
+const (
+	DiffChars = "char"
+	DiffWords = "word"
+	DiffLines = "line"
+)
+
+var diffGranularity = map[string]bool{DiffChars: true, DiffWords: true, DiffLines: true}
+
 func diffHTML(text1, text2 string) string {
+	return renderDiffHTML(diffText(text1, text2, DiffChars))
+}
+
+// diffText compares texts by characters, words or lines
+func diffText(text1, text2, granularity string) []diffLib.Diff {
 	dmp := diffLib.New()
-	diffs := dmp.DiffMain(text1, text2, false)
+	if granularity != DiffWords && granularity != DiffLines {
+		return dmp.DiffMain(text1, text2, false)
+	}
+
+	split := splitWords
+	if granularity == DiffLines {
+		split = splitLines
+	}
+
+	// each token is encoded as a single rune, so the diff can't break it
+	tokens := make([]string, 0)
+	index := make(map[string]rune)
+	encode := func(text string) []rune {
+		parts := split(text)
+		out := make([]rune, len(parts))
+		for i, p := range parts {
+			r, ok := index[p]
+			if !ok {
+				r = tokenRune(len(tokens))
+				index[p] = r
+				tokens = append(tokens, p)
+			}
+			out[i] = r
+		}
+		return out
+	}
 
+	diffs := dmp.DiffMainRunes(encode(text1), encode(text2), false)
+	for i := range diffs {
+		var text strings.Builder
+		for _, r := range diffs[i].Text {
+			text.WriteString(tokens[runeToken(r)])
+		}
+		diffs[i].Text = text.String()
+	}
+
+	return diffs
+}
+
+// surrogates can't be stored in strings, so they are skipped
+func tokenRune(i int) rune {
+	r := rune(i + 1)
+	if r >= 0xD800 {
+		r += 0x800
+	}
+	return r
+}
+
+func runeToken(r rune) int {
+	if r >= 0xE000 {
+		r -= 0x800
+	}
+	return int(r) - 1
+}
+
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// splitWords splits text to words, whitespaces and separate punctuation marks
+func splitWords(text string) []string {
+	words := make([]string, 0)
+	start := -1
+	kind := 0
+
+	for i, r := range text {
+		k := 3
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			k = 1
+		} else if unicode.IsSpace(r) {
+			k = 2
+		}
+
+		if start != -1 && (k != kind || k == 3) {
+			words = append(words, text[start:i])
+			start = -1
+		}
+		if start == -1 {
+			start = i
+			kind = k
+		}
+	}
+	if start != -1 {
+		words = append(words, text[start:])
+	}
+
+	return words
+}
+
+func renderDiffHTML(diffs []diffLib.Diff) string {
 	var buff bytes.Buffer
 	for _, diff := range diffs {
 		text := html.EscapeString(diff.Text)
@@ -39,3 +147,140 @@ func diffHTML(text1, text2 string) string {
 
 	return buff.String()
 }
+
+// DiffChunk is a group of lines with the same type of change, line numbers start from 1
+type DiffChunk struct {
+	Type     string   `json:"type"`
+	OldStart int      `json:"old_start"`
+	OldLines int      `json:"old_lines"`
+	NewStart int      `json:"new_start"`
+	NewLines int      `json:"new_lines"`
+	Lines    []string `json:"lines"`
+}
+
+var chunkTypes = map[diffLib.Operation]string{
+	diffLib.DiffInsert: "insert",
+	diffLib.DiffDelete: "delete",
+	diffLib.DiffEqual:  "equal",
+}
+
+// number of unchanged lines around changes in the unified diff
+const unifiedContext = 3
+
+type lineOp struct {
+	Type diffLib.Operation
+	Text string
+}
+
+// lineOps returns the line diff, and numbers of lines in both texts before each operation
+func lineOps(text1, text2 string) ([]lineOp, []int, []int) {
+	ops := make([]lineOp, 0)
+	for _, d := range diffText(text1, text2, DiffLines) {
+		for _, line := range splitLines(d.Text) {
+			ops = append(ops, lineOp{Type: d.Type, Text: line})
+		}
+	}
+
+	oldNum := make([]int, len(ops)+1)
+	newNum := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldNum[i+1] = oldNum[i]
+		newNum[i+1] = newNum[i]
+		if op.Type != diffLib.DiffInsert {
+			oldNum[i+1]++
+		}
+		if op.Type != diffLib.DiffDelete {
+			newNum[i+1]++
+		}
+	}
+
+	return ops, oldNum, newNum
+}
+
+// diffChunks returns typed chunks of the line diff
+func diffChunks(text1, text2 string) []DiffChunk {
+	ops, oldNum, newNum := lineOps(text1, text2)
+
+	chunks := make([]DiffChunk, 0)
+	for i, op := range ops {
+		last := len(chunks) - 1
+		if last < 0 || chunks[last].Type != chunkTypes[op.Type] {
+			chunks = append(chunks, DiffChunk{Type: chunkTypes[op.Type], OldStart: oldNum[i] + 1, NewStart: newNum[i] + 1})
+			last++
+		}
+
+		c := &chunks[last]
+		if op.Type != diffLib.DiffInsert {
+			c.OldLines++
+		}
+		if op.Type != diffLib.DiffDelete {
+			c.NewLines++
+		}
+		c.Lines = append(c.Lines, strings.TrimSuffix(strings.TrimSuffix(op.Text, "\n"), "\r"))
+	}
+
+	return chunks
+}
+
+// unifiedDiff returns the patch in the unified format, it is empty for equal texts
+func unifiedDiff(name1, name2, text1, text2 string) string {
+	ops, oldNum, newNum := lineOps(text1, text2)
+
+	var buff bytes.Buffer
+	for i := 0; i < len(ops); {
+		if ops[i].Type == diffLib.DiffEqual {
+			i++
+			continue
+		}
+
+		// changes divided by a few unchanged lines belong to the same hunk
+		lastChange := i
+		for j := i + 1; j < len(ops) && j-lastChange-1 <= 2*unifiedContext; j++ {
+			if ops[j].Type != diffLib.DiffEqual {
+				lastChange = j
+			}
+		}
+
+		start := i - unifiedContext
+		if start < 0 {
+			start = 0
+		}
+		end := lastChange + 1 + unifiedContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		if buff.Len() == 0 {
+			fmt.Fprintf(&buff, "--- a/%s\n+++ b/%s\n", name1, name2)
+		}
+		fmt.Fprintf(&buff, "@@ -%s +%s @@\n",
+			hunkRange(oldNum[start], oldNum[end]-oldNum[start]), hunkRange(newNum[start], newNum[end]-newNum[start]))
+
+		for _, op := range ops[start:end] {
+			switch op.Type {
+			case diffLib.DiffInsert:
+				buff.WriteString("+")
+			case diffLib.DiffDelete:
+				buff.WriteString("-")
+			default:
+				buff.WriteString(" ")
+			}
+			buff.WriteString(op.Text)
+			if !strings.HasSuffix(op.Text, "\n") {
+				buff.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return buff.String()
+}
+
+// an empty range points to the line before it
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/xbsoftware/wfs"
+	db "github.com/xbsoftware/wfs-db"
+)
+
+// TreeAdapter stores files of all users in the same table, each user has a separate tree
+// files from the trees of other users are addressed as ~{tree}/{path}
+type TreeAdapter struct {
+	contentFolder string
+	root          int
+	db            *sqlx.DB
+}
+
+// likeEscape escapes wildcards of LIKE patterns, so names with % and _ match literally
+var likeEscape = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+type FileID struct {
+	info *db.DBFile
+	root int
+}
+
+func (f FileID) GetPath() string {
+	return f.info.Path
+}
+func (f FileID) IsFolder() bool {
+	return f.info.IsDir()
+}
+func (f FileID) ClientID() string {
+	return clientID(f.info.Tree, f.info.Path, f.root)
+}
+func (f FileID) File() *db.DBFile {
+	return f.info
+}
+func (f FileID) Contains(t wfs.FileID) bool {
+	return f.info.Tree == t.(FileID).info.Tree && strings.HasPrefix(f.GetPath(), t.GetPath()+"/")
+}
+
+type fileInfo struct {
+	os.FileInfo
+	f wfs.FileID
+}
+
+func (i *fileInfo) File() wfs.FileID {
+	return i.f
+}
+
+// parseID converts client id to the tree and the path inside of it
+func parseID(id string, root int) (int, string) {
+	if !strings.HasPrefix(id, "~") {
+		return root, id
+	}
+
+	end := strings.Index(id, "/")
+	if end == -1 {
+		end = len(id)
+	}
+
+	tree, err := strconv.Atoi(id[1:end])
+	if err != nil {
+		return root, id
+	}
+
+	p := id[end:]
+	if p == "" {
+		p = "/"
+	}
+	return tree, p
+}
+
+// clientID is the reverse of parseID
+func clientID(tree int, p string, root int) string {
+	if tree == root {
+		return p
+	}
+	if p == "/" {
+		return "~" + strconv.Itoa(tree)
+	}
+	return "~" + strconv.Itoa(tree) + p
+}
+
+var drives = make(map[int]wfs.Drive)
+var drivesLock sync.Mutex
+
+// getDrive returns the drive of the user, the drive is created on first use
+func getDrive(user *CurrentUser) wfs.Drive {
+	drivesLock.Lock()
+	defer drivesLock.Unlock()
+
+	drive, ok := drives[user.ID]
+	if !ok {
+		drive = newTreeDrive(user)
+		drives[user.ID] = drive
+	}
+
+	return drive
+}
+
+func newTreeDrive(user *CurrentUser) wfs.Drive {
+	config := driveConfig
+	policy := wfs.Policy(&SharePolicy{User: user.ID, Root: user.Root})
+	if config.Policy != nil {
+		policy = wfs.CombinedPolicy{Policies: []wfs.Policy{*config.Policy, policy}}
+	}
+	config.Policy = &policy
+
+	adapter := &TreeAdapter{contentFolder: Config.DataFolder, root: user.Root, db: conn}
+	return wfs.NewDrive(adapter, &config)
+}
+
+// getUserRoot returns id of the user's tree, the tree is created on first login
+func getUserRoot(uid int) (int, error) {
+	root := -1
+	err := conn.Get(&root, "SELECT root FROM user WHERE id = ?", uid)
+	if err != nil || root != 0 {
+		return root, err
+	}
+
+	tx, err := conn.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// root entity of the tree has the same id as the tree itself
+	res, err := tx.Exec("INSERT INTO entity(name, folder, type, tree, path) VALUES(\"\", 0, ?, 0, \"/\")", db.FolderRecord)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := res.LastInsertId()
+	root = int(id)
+
+	_, err = tx.Exec("UPDATE entity SET tree = ? WHERE id = ?", root, root)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err = tx.Exec("UPDATE user SET root = ? WHERE id = ? AND root = 0", root, uid)
+	if err != nil {
+		return 0, err
+	}
+
+	// a parallel request has already created the tree
+	if count, _ := res.RowsAffected(); count == 0 {
+		tx.Rollback()
+		err = conn.Get(&root, "SELECT root FROM user WHERE id = ?", uid)
+		return root, err
+	}
+
+	return root, tx.Commit()
+}
+
+const fileFields = "id, name, type, content, size, modified, folder, path, tree"
+
+// the same fields for queries with joins
+const entityFields = "entity.id, entity.name, entity.type, entity.content, entity.size, entity.modified, entity.folder, entity.path, entity.tree"
+
+func (d *TreeAdapter) newDBFile(id int) (*db.DBFile, error) {
+	t := db.DBFile{}
+	err := d.db.Get(&t, "SELECT "+fileFields+" FROM entity WHERE id = ?", id)
+	return &t, err
+}
+
+func (d *TreeAdapter) fileID(info *db.DBFile) FileID {
+	return FileID{info: info, root: d.root}
+}
+
+func (d *TreeAdapter) Comply(f wfs.FileID, operation int) bool {
+	return f.(FileID).File().ID != 0
+}
+
+func (d *TreeAdapter) GetParent(f wfs.FileID) wfs.FileID {
+	info := f.(FileID).File()
+	if info.Folder == 0 {
+		return f
+	}
+
+	p, err := d.newDBFile(info.Folder)
+	if err != nil {
+		return d.fileID(&db.DBFile{Tree: info.Tree, Path: path.Dir(info.Path)})
+	}
+
+	return d.fileID(p)
+}
+
+func (d *TreeAdapter) ToFileID(id string) wfs.FileID {
+	tree, p := parseID(id, d.root)
+
+	t := db.DBFile{}
+	err := d.db.Get(&t, "SELECT "+fileFields+" FROM entity WHERE path = ? AND tree = ?", p, tree)
+	if err != nil {
+		t = db.DBFile{Tree: tree, Path: p}
+	}
+
+	return d.fileID(&t)
+}
+
+func (d *TreeAdapter) Remove(f wfs.FileID) error {
+	df := f.(FileID).File()
+
+	blobs := make([]string, 0)
+	d.db.Select(&blobs, "SELECT content FROM entity WHERE (id = ? OR path LIKE ? AND tree = ?) AND content != ''", df.ID, likeEscape.Replace(df.Path)+"/%", df.Tree)
+
+	_, err := d.db.Exec("DELETE FROM entity WHERE id = ?", df.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("DELETE FROM entity WHERE path LIKE ? AND tree = ?", likeEscape.Replace(df.Path)+"/%", df.Tree)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range blobs {
+		releaseBlob(name)
+	}
+	return nil
+}
+
+func (d *TreeAdapter) Read(f wfs.FileID) (io.ReadSeeker, error) {
+	df := f.(FileID).File()
+	if df.Content == "" {
+		return nil, errors.New("Can't open file for reading")
+	}
+
+	file, err := os.Open(filepath.Join(d.contentFolder, df.Content))
+	if err != nil {
+		return nil, errors.New("Can't open file for reading")
+	}
+	return file, nil
+}
+
+func (d *TreeAdapter) Write(f wfs.FileID, data io.Reader) error {
+	name, size, err := saveBlob(d.contentFolder, data)
+	if err != nil {
+		return err
+	}
+
+	df := f.(FileID).File()
+	old, err := d.replaceContent(df.ID, name, size)
+	if err != nil {
+		releaseBlob(name)
+		return err
+	}
+
+	releaseBlob(old)
+	return nil
+}
+
+// replaceContent sets the new content of the file and returns the old one
+func (d *TreeAdapter) replaceContent(id int, name string, size int64) (string, error) {
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var old string
+	err = tx.Get(&old, "SELECT content FROM entity WHERE id = ? FOR UPDATE", id)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec("UPDATE entity SET size = ?, content = ?, modified = ? WHERE id = ?",
+		size, name, time.Now(), id)
+	if err != nil {
+		return "", err
+	}
+
+	return old, tx.Commit()
+}
+
+func (d *TreeAdapter) Make(f wfs.FileID, name string, isFolder bool) (wfs.FileID, error) {
+	df := f.(FileID).File()
+
+	fileType := db.FileRecord
+	if isFolder {
+		fileType = db.FolderRecord
+	}
+
+	res, err := d.db.Exec("INSERT INTO entity(name, path, folder, modified, size, type, tree) VALUES(?, ?, ?, now(), 0, ?, ?)",
+		name, path.Join(df.Path, name), df.ID, fileType, df.Tree)
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := res.LastInsertId()
+	nf, err := d.newDBFile(int(id))
+	if err != nil {
+		return nil, err
+	}
+
+	return d.fileID(nf), nil
+}
+
+const copySQL = "INSERT INTO entity(name, folder, content, type, modified, size, tree, path) VALUES(?, ?, ?, ?, ?, ?, ?, ?)"
+const copyTextSQL = "INSERT INTO entity_text(entity_id, content) SELECT ?, content FROM entity_text WHERE entity_id = ?"
+
+func (d *TreeAdapter) Copy(source, target wfs.FileID, name string, isFolder bool) (wfs.FileID, error) {
+	df := source.(FileID).File()
+	dt := target.(FileID).File()
+
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// copied files are locked, so their content can't be released till the blobs are referenced by copies
+	src := db.DBFile{}
+	err = tx.Get(&src, "SELECT "+fileFields+" FROM entity WHERE id = ? FOR UPDATE", df.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	full := path.Join(dt.Path, name)
+	res, err := tx.Exec(copySQL, name, dt.ID, src.Content, src.Type, src.LastModTime, src.FileSize, dt.Tree, full)
+	if err != nil {
+		return nil, err
+	}
+	err = addBlobRef(tx, src.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := res.LastInsertId()
+	_, err = tx.Exec(copyTextSQL, id, src.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.copyRec(tx, src.ID, int(id), dt.Tree, full)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := d.newDBFile(int(id))
+	return d.fileID(info), err
+}
+
+func (d *TreeAdapter) copyRec(tx *sqlx.Tx, from, to, tree int, full string) error {
+	files := make([]db.DBFile, 0)
+	err := tx.Select(&files, "SELECT "+fileFields+" FROM entity WHERE folder = ? FOR UPDATE", from)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		fixedPath := path.Join(full, f.FileName)
+		res, err := tx.Exec(copySQL, f.FileName, to, f.Content, f.Type, f.LastModTime, f.FileSize, tree, fixedPath)
+		if err != nil {
+			return err
+		}
+		err = addBlobRef(tx, f.Content)
+		if err != nil {
+			return err
+		}
+
+		id, _ := res.LastInsertId()
+		_, err = tx.Exec(copyTextSQL, id, f.ID)
+		if err != nil {
+			return err
+		}
+
+		if f.Type == db.FolderRecord {
+			err = d.copyRec(tx, f.ID, int(id), tree, fixedPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Move renames(moves) a file or a folder
+func (d *TreeAdapter) Move(source, target wfs.FileID, name string, isFolder bool) (wfs.FileID, error) {
+	df := source.(FileID).File()
+	dt := target.(FileID).File()
+
+	// the folder and its kids are moved together, so a failure can't leave kids at the old path
+	tx, err := d.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	full := path.Join(dt.Path, name)
+	_, err = tx.Exec("UPDATE entity SET name = ?, folder = ?, path = ?, tree = ? WHERE id = ?", name, dt.ID, full, dt.Tree, df.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// update path for all kids
+	files := make([]db.DBFile, 0)
+	err = tx.Select(&files, "SELECT id, path FROM entity WHERE path LIKE ? AND tree = ? FOR UPDATE", likeEscape.Replace(df.Path)+"/%", df.Tree)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		_, err = tx.Exec("UPDATE entity SET path = ?, tree = ? WHERE id = ?", full+f.Path[len(df.Path):], dt.Tree, f.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := d.newDBFile(df.ID)
+	return d.fileID(info), err
+}
+
+// Info returns info about a single file
+func (d *TreeAdapter) Info(f wfs.FileID) (wfs.FileInfo, error) {
+	return &fileInfo{f.(FileID).File(), f}, nil
+}
+
+func (d *TreeAdapter) Search(f wfs.FileID, s string) ([]wfs.FileInfo, error) {
+	df := f.(FileID).File()
+
+	prefix := likeEscape.Replace(df.Path) + "/%"
+	if df.Path == "/" {
+		prefix = "/%"
+	}
+
+	dir := make([]db.DBFile, 0)
+	err := d.db.Select(&dir, "SELECT "+fileFields+" FROM entity WHERE tree = ? AND path LIKE ? AND name LIKE ?", df.Tree, prefix, "%"+likeEscape.Replace(s)+"%")
+	if err != nil {
+		return nil, err
+	}
+
+	return d.toInfo(dir), nil
+}
+
+func (d *TreeAdapter) List(f wfs.FileID) ([]wfs.FileInfo, error) {
+	dir := make([]db.DBFile, 0)
+	err := d.db.Select(&dir, "SELECT "+fileFields+" FROM entity WHERE folder = ?", f.(FileID).File().ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.toInfo(dir), nil
+}
+
+func (d *TreeAdapter) toInfo(dir []db.DBFile) []wfs.FileInfo {
+	info := make([]wfs.FileInfo, 0, len(dir))
+	for i := range dir {
+		info = append(info, &fileInfo{&dir[i], d.fileID(&dir[i])})
+	}
+
+	return info
+}
+
+func (d *TreeAdapter) Exists(f wfs.FileID, name string) bool {
+	df := f.(FileID).File()
+	if name == "" {
+		return df.ID != 0
+	}
+
+	count := 0
+	d.db.Get(&count, "SELECT count(id) FROM entity WHERE folder = ? AND name = ?", df.ID, name)
+	return count > 0
+}
+
+// Stats returns the logical size of files and versions, physical size is reported by getUsage
+func (d *TreeAdapter) Stats() (uint64, uint64, error) {
+	used, _, err := getUsage(d.root)
+	return used, 0, err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"html"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// max size of a file, which content will be indexed
+const maxIndexSize = 20 * 1000 * 1000
+
+// max length of text stored in the index
+const maxIndexText = 1000 * 1000
+
+var plainTextExt = map[string]bool{
+	"txt": true, "md": true, "csv": true, "log": true,
+	"js": true, "ts": true, "mjs": true, "json": true, "css": true, "scss": true, "sass": true, "less": true,
+	"php": true, "sh": true, "coffee": true, "go": true, "py": true, "sql": true,
+	"yml": true, "yaml": true, "xml": true, "ini": true, "conf": true,
+}
+
+var htmlExt = map[string]bool{"html": true, "htm": true, "phtml": true}
+
+// extractText returns plain text of the document, or an empty string for unsupported formats
+func extractText(name string, data io.Reader) (string, error) {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+
+	var text string
+	var err error
+	switch {
+	case plainTextExt[ext]:
+		var buf []byte
+		buf, err = ioutil.ReadAll(io.LimitReader(data, maxIndexText))
+		text = string(buf)
+	case htmlExt[ext]:
+		var buf []byte
+		buf, err = ioutil.ReadAll(io.LimitReader(data, maxIndexSize))
+		text = htmlToText(string(buf))
+	case ext == "docx":
+		text, err = docxToText(data)
+	case ext == "pdf":
+		text, err = pdfToText(data)
+	}
+
+	if len(text) > maxIndexText {
+		text = text[:maxIndexText]
+	}
+	return strings.ToValidUTF8(text, ""), err
+}
+
+var htmlSkip = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+var htmlTag = regexp.MustCompile(`(?s)<[^>]*>`)
+
+func htmlToText(s string) string {
+	s = htmlSkip.ReplaceAllString(s, " ")
+	s = htmlTag.ReplaceAllString(s, " ")
+	return html.UnescapeString(s)
+}
+
+func docxToText(data io.Reader) (string, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(data, maxIndexSize))
+	if err != nil {
+		return "", err
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return "", err
+	}
+
+	for _, f := range archive.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+
+		doc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer doc.Close()
+
+		var out strings.Builder
+		inText := false
+		decoder := xml.NewDecoder(io.LimitReader(doc, maxIndexSize))
+		for out.Len() < maxIndexText {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return out.String(), err
+			}
+
+			switch t := token.(type) {
+			case xml.StartElement:
+				inText = t.Name.Local == "t"
+			case xml.EndElement:
+				inText = false
+				if t.Name.Local == "p" {
+					out.WriteString("\n")
+				}
+			case xml.CharData:
+				if inText {
+					out.Write(t)
+				}
+			}
+		}
+
+		return out.String(), nil
+	}
+
+	return "", nil
+}
+
+var pdfStream = regexp.MustCompile(`(?s)stream\r?\n(.*?)\r?\nendstream`)
+var pdfTextBlock = regexp.MustCompile(`(?s)BT(.*?)ET`)
+var pdfString = regexp.MustCompile(`\(((?:\\.|[^\\)])*)\)`)
+var pdfEscape = strings.NewReplacer(`\n`, "\n", `\r`, "", `\t`, " ", `\(`, "(", `\)`, ")", `\\`, `\`)
+
+// pdfToText extracts literal strings from text blocks of the document
+// it doesn't support custom font encodings, so text of some documents can't be extracted
+func pdfToText(data io.Reader) (string, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(data, maxIndexSize))
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	for _, stream := range pdfStream.FindAllSubmatch(buf, -1) {
+		if out.Len() >= maxIndexText {
+			break
+		}
+
+		content := stream[1]
+		if reader, err := zlib.NewReader(bytes.NewReader(content)); err == nil {
+			// compressed streams are limited, so a small document can't inflate to gigabytes
+			content, _ = ioutil.ReadAll(io.LimitReader(reader, maxIndexText))
+			reader.Close()
+		}
+
+		for _, block := range pdfTextBlock.FindAllSubmatch(content, -1) {
+			for _, s := range pdfString.FindAllSubmatch(block[1], -1) {
+				out.WriteString(pdfEscape.Replace(string(s[1])))
+			}
+			out.WriteString("\n")
+		}
+	}
+
+	return out.String(), nil
+}
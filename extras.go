@@ -30,30 +30,25 @@ type UserInfo struct {
 	Avatar string `json:"avatar"`
 }
 
-type CommentInfo struct {
-	ID       int       `json:"id"`
-	Content  string    `json:"text"`
-	Modified time.Time `json:"date"`
-	UserId   int       `db:"user_id" json:"user_id"`
-}
-
-type CurrentUser struct {
-	ID   int
-	Root int
-}
-
 type EditInfo struct {
 	ID       int        `json:"id"`
 	Modified time.Time  `json:"date"`
 	User     int        `db:"user_id" json:"user"`
 	Content  string     `json:"content"`
 	Origin   *time.Time `json:"origin"`
+	// named and pinned versions are never pruned
+	Label       string `json:"label,omitempty"`
+	Description string `json:"description,omitempty"`
+	Pinned      bool   `json:"pinned,omitempty"`
+	// type of the change, paths are stored for renames, moves and restores
+	Event   string `json:"event"`
+	OldPath string `db:"old_path" json:"old_path,omitempty"`
+	NewPath string `db:"new_path" json:"new_path,omitempty"`
 }
 
-var User = CurrentUser{1, 1}
-
-func dbID(id string) (res int) {
-	conn.Get(&res, "select id from entity where path =? and tree = ?", id, User.Root)
+func dbID(id string, user *CurrentUser) (res int) {
+	tree, path := parseID(id, user.Root)
+	conn.Get(&res, "select id from entity where path =? and tree = ?", path, tree)
 	return res
 }
 
@@ -66,8 +61,13 @@ func addExtrasRoutes(r chi.Router) {
 	})
 
 	r.Get("/tags", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		id := r.URL.Query().Get("id")
-		did := dbID(id)
+		did := dbID(id, user)
+		if !hasAccess(user, did, ViewerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
 
 		ids := make([]int, 0)
 		conn.Select(&ids, "select tag_id from entity_tag where entity_id = ? ", did)
@@ -76,9 +76,14 @@ func addExtrasRoutes(r chi.Router) {
 	})
 
 	r.Put("/tags", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		r.ParseForm()
 		id := r.Form.Get("id")
-		did := dbID(id)
+		did := dbID(id, user)
+		if !hasAccess(user, did, EditorAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
 		tags := strings.Split(r.Form.Get("value"), ",")
 
 		conn.Exec("delete from entity_tag WHERE entity_id = ?", did)
@@ -144,127 +149,221 @@ func addExtrasRoutes(r chi.Router) {
 	})
 
 	r.Post("/favorite", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		r.ParseForm()
 		id := r.Form.Get("id")
-		did := dbID(id)
+		did := dbID(id, user)
+		if !hasAccess(user, did, ViewerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
 
-		conn.Exec("INSERT INTO favorite(entity_id, user_id) values(?, ?)", did, User.ID)
+		conn.Exec("INSERT INTO favorite(entity_id, user_id) values(?, ?)", did, user.ID)
 		format.JSON(w, 200, Response{ID: id})
 	})
 
 	r.Delete("/favorite", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		id := r.URL.Query().Get("id")
-		did := dbID(id)
+		did := dbID(id, user)
 
-		conn.Exec("DELETE FROM favorite WHERE entity_id = ? and user_id = ?", did, User.ID)
+		conn.Exec("DELETE FROM favorite WHERE entity_id = ? and user_id = ?", did, user.ID)
 		format.JSON(w, 200, Response{ID: id})
 	})
 
 	r.Post("/share", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		r.ParseForm()
 		id := r.Form.Get("id")
 		uid := r.Form.Get("user")
-		did := dbID(id)
+		access, ok := accessNames[r.Form.Get("access")]
+		if !ok {
+			access = ViewerAccess
+		}
+		did := dbID(id, user)
+		if !hasAccess(user, did, OwnerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
 
-		conn.Exec("INSERT INTO entity_user(entity_id, user_id) values(?, ?)", did, uid)
+		conn.Exec("DELETE FROM entity_user WHERE entity_id = ? and user_id = ?", did, uid)
+		conn.Exec("INSERT INTO entity_user(entity_id, user_id, access) values(?, ?, ?)", did, uid, access)
 		format.JSON(w, 200, Response{ID: id})
 	})
 
 	r.Delete("/share", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		id := r.URL.Query().Get("id")
 		uid := r.URL.Query().Get("user")
-		did := dbID(id)
+		did := dbID(id, user)
+		if !hasAccess(user, did, OwnerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
 
 		conn.Exec("DELETE FROM entity_user WHERE entity_id = ? and user_id = ?", did, uid)
 		format.JSON(w, 200, Response{ID: id})
 	})
 
-	r.Get("/comments", func(w http.ResponseWriter, r *http.Request) {
+	r.Get("/versions", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		id := r.URL.Query().Get("id")
-		did := dbID(id)
-
-		comments := make([]CommentInfo, 0)
-		conn.Select(&comments, "select id,content,user_id,modified from comment where entity_id = ?", did)
-
-		format.JSON(w, 200, comments)
-	})
+		did := dbID(id, user)
+		if !hasAccess(user, did, ViewerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+		logAccess(user, did)
+
+		// history can be filtered by the type of event
+		where := ""
+		args := []interface{}{did}
+		if event := r.URL.Query().Get("event"); event != "" {
+			where = " AND event = ?"
+			args = append(args, event)
+		}
 
-	r.Post("/comments", func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		id := r.URL.Query().Get("id")
-		did := dbID(id)
-		content := r.Form.Get("value")
+		versions := make([]EditInfo, 0)
+		err := conn.Select(&versions, "SELECT id,modified,user_id,origin,label,COALESCE(description, '') AS description,pinned,event,old_path,new_path FROM entity_edit WHERE entity_id = ?"+where+" ORDER BY modified desc, id desc", args...)
+		if err != nil {
+			panic(err)
+		}
 
-		res, _ := conn.Exec("insert into comment(entity_id, user_id, content)  values(?, ?, ?)", did, User.ID, content)
-		cid, _ := res.LastInsertId()
-		format.JSON(w, 200, Response{ID: strconv.FormatInt(cid, 10)})
+		format.JSON(w, 200, versions)
 	})
 
-	r.Put("/comments/{id}", func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		id := chi.URLParam(r, "id")
-		content := r.Form.Get("value")
+	r.Get("/versions/compare", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		from := r.URL.Query().Get("from")
+		to := r.URL.Query().Get("to")
 
-		var uid int
-		conn.Get(&uid, "select user_id from comment where id = ?", id)
-		if uid != User.ID {
-			format.Text(w, 500, "Access Denied")
+		granularity, err := getGranularity(r)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+		diffFormat := r.URL.Query().Get("format")
+		if !diffFormats[diffFormat] {
+			format.Text(w, 500, "incorrect format value")
 			return
 		}
 
-		conn.Exec("update comment SET content = ? WHERE id = ?", content, id)
-		format.JSON(w, 200, Response{ID: id})
-	})
-
-	r.Delete("/comments/{id}", func(w http.ResponseWriter, r *http.Request) {
-		id := chi.URLParam(r, "id")
-
-		var uid int
-		conn.Get(&uid, "select user_id from comment where id = ?", id)
-		if uid != User.ID {
+		var edit struct {
+			EntityID int `db:"entity_id"`
+			Content  string
+		}
+		err = conn.Get(&edit, "SELECT entity_id, content FROM entity_edit WHERE id = ?", from)
+		if err != nil || !hasAccess(user, edit.EntityID, ViewerAccess) {
 			format.Text(w, 500, "Access Denied")
 			return
 		}
+		if edit.Content == "" {
+			format.Text(w, 500, "the record has no content")
+			return
+		}
+		logAccess(user, edit.EntityID)
+
+		// without the second version, the live file is used
+		var content string
+		if to == "" || to == "current" {
+			err = conn.Get(&content, "SELECT content FROM entity WHERE id = ?", edit.EntityID)
+		} else {
+			err = conn.Get(&content, "SELECT content FROM entity_edit WHERE id = ? AND entity_id = ?", to, edit.EntityID)
+		}
+		if err != nil || content == "" {
+			format.Text(w, 500, "wrong version of the file")
+			return
+		}
 
-		conn.Exec("delete from comment WHERE id = ?", id)
-		format.JSON(w, 200, Response{ID: id})
-	})
+		text1 := getTextFromFile(filepath.Join(Config.DataFolder, edit.Content))
+		text2 := getTextFromFile(filepath.Join(Config.DataFolder, content))
 
-	r.Get("/versions", func(w http.ResponseWriter, r *http.Request) {
-		id := r.URL.Query().Get("id")
-		did := dbID(id)
-
-		versions := make([]EditInfo, 0)
-		err := conn.Select(&versions, "SELECT id,modified,user_id,origin FROM entity_edit WHERE entity_id = ? ORDER BY modified desc", did)
-		if err != nil {
-			panic(err)
+		if diffFormat == "unified" || diffFormat == "json" {
+			writeDiff(w, diffFormat, edit.EntityID, text1, text2)
+			return
 		}
 
-		format.JSON(w, 200, versions)
+		w.Header().Add("Content-type", "text/plain")
+		io.WriteString(w, renderDiffHTML(diffText(text1, text2, granularity)))
 	})
 
 	r.Get("/versions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		id := chi.URLParam(r, "id")
 		_, diff := r.URL.Query()["diff"]
 
+		var did int
+		conn.Get(&did, "SELECT entity_id FROM entity_edit WHERE id = ?", id)
+		if !hasAccess(user, did, ViewerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+		logAccess(user, did)
+
+		diffFormat := r.URL.Query().Get("format")
+		if !diffFormats[diffFormat] {
+			format.Text(w, 500, "incorrect format value")
+			return
+		}
+		// machine readable formats always contain the diff
+		if diffFormat == "unified" || diffFormat == "json" {
+			diff = true
+		}
+
 		var content, previous string
 		conn.Get(&content, "SELECT content FROM entity_edit WHERE id = ?", id)
+		if content == "" {
+			format.Text(w, 500, "the record has no content")
+			return
+		}
 		if diff {
 			conn.Get(&previous, "SELECT previous FROM entity_edit WHERE id = ?", id)
 		}
 
 		mode := r.URL.Query().Get("mode")
-		if mode == "text" {
-			w.Header().Add("Content-type", "text/plain")
+		if mode == "image-diff" {
+			if previous == "" {
+				conn.Get(&previous, "SELECT previous FROM entity_edit WHERE id = ?", id)
+			}
+			serveImageDiff(w, r, did, content, previous)
+
+		} else if diffFormat == "unified" || diffFormat == "json" {
+			text1 := ""
+			if previous != "" {
+				text1 = getTextFromFile(filepath.Join(Config.DataFolder, previous))
+			}
+			text2 := getTextFromFile(filepath.Join(Config.DataFolder, content))
+			writeDiff(w, diffFormat, did, text1, text2)
+
+		} else if mode == "text" {
 			text2 := getTextFromFile(filepath.Join(Config.DataFolder, content))
 
+			var out string
 			if previous != "" {
+				granularity, err := getGranularity(r)
+				if err != nil {
+					format.Text(w, 500, err.Error())
+					return
+				}
 				text1 := getTextFromFile(filepath.Join(Config.DataFolder, previous))
-				io.WriteString(w, diffHTML(text1, text2))
+				out = renderDiffHTML(diffText(text1, text2, granularity))
+			} else {
+				out = html.EscapeString(text2)
+			}
+
+			// text with anchors of comments
+			if _, ok := r.URL.Query()["comments"]; ok {
+				comments, err := getVersionComments(id)
+				if err != nil {
+					format.Text(w, 500, err.Error())
+					return
+				}
+				format.JSON(w, 200, VersionText{HTML: out, Comments: comments})
 				return
 			}
 
-			io.WriteString(w, html.EscapeString(text2))
+			w.Header().Add("Content-type", "text/plain")
+			io.WriteString(w, out)
 
 		} else if mode == "binary" {
 			data, err := os.Open(filepath.Join(Config.DataFolder, content))
@@ -277,30 +376,104 @@ func addExtrasRoutes(r chi.Router) {
 		}
 	})
 
+	r.Put("/versions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		r.ParseForm()
+		id := chi.URLParam(r, "id")
+
+		var did int
+		conn.Get(&did, "SELECT entity_id FROM entity_edit WHERE id = ?", id)
+		if !hasAccess(user, did, EditorAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		// only provided fields are changed
+		var err error
+		if _, ok := r.Form["label"]; ok {
+			_, err = conn.Exec("UPDATE entity_edit SET label = ? WHERE id = ?", strings.TrimSpace(r.Form.Get("label")), id)
+		}
+		if _, ok := r.Form["description"]; ok && err == nil {
+			_, err = conn.Exec("UPDATE entity_edit SET description = ? WHERE id = ?", r.Form.Get("description"), id)
+		}
+		if _, ok := r.Form["pinned"]; ok && err == nil {
+			_, err = conn.Exec("UPDATE entity_edit SET pinned = ? WHERE id = ?", !isNo(r.Form.Get("pinned")), id)
+		}
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
+		}
+
+		format.JSON(w, 200, Response{ID: id})
+	})
+
 	r.Post("/versions", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		drive := user.Drive
 		r.ParseForm()
 		id := r.Form.Get("id")
 		version := r.Form.Get("version")
+		label := r.Form.Get("label")
 
+		// the latest version with the label is restored
 		var edit EditInfo
-		conn.Get(&edit, "SELECT content, modified FROM entity_edit WHERE id = ?", version)
+		var err error
+		if label != "" {
+			err = conn.Get(&edit, "SELECT content, modified FROM entity_edit WHERE label = ? AND entity_id = ? AND content != '' ORDER BY modified desc LIMIT 1", label, dbID(id, user))
+		} else {
+			err = conn.Get(&edit, "SELECT content, modified FROM entity_edit WHERE id = ? AND entity_id = ?", version, dbID(id, user))
+		}
+		if err != nil || edit.Content == "" {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
 
 		file, err := os.Open(filepath.Join(Config.DataFolder, edit.Content))
 		if err != nil {
 			panic(errors.New("Can't open file for reading"))
 		}
+		defer file.Close()
 
 		err = drive.Write(id, file)
 		if err != nil {
 			panic(err)
 		}
+		updateIndex(dbID(id, user))
 
-		info, _ := saveVersion(id, &edit.Modified)
+		info, _ := saveVersion(id, user, &edit.Modified)
 
 		format.JSON(w, 200, info)
 	})
 }
 
+var diffFormats = map[string]bool{"": true, "html": true, "unified": true, "json": true}
+
+// writeDiff sends the line diff as a patch or as json chunks
+func writeDiff(w http.ResponseWriter, diffFormat string, did int, text1, text2 string) {
+	if diffFormat == "json" {
+		format.JSON(w, 200, diffChunks(text1, text2))
+		return
+	}
+
+	var name string
+	conn.Get(&name, "SELECT name FROM entity WHERE id = ?", did)
+
+	w.Header().Add("Content-type", "text/x-diff")
+	io.WriteString(w, unifiedDiff(name, name, text1, text2))
+}
+
+func getGranularity(r *http.Request) (string, error) {
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		return DiffChars, nil
+	}
+	if !diffGranularity[granularity] {
+		return "", errors.New("incorrect granularity value")
+	}
+
+	return granularity, nil
+}
+
 func getTextFromFile(path string) string {
 	d, err := ioutil.ReadFile(path)
 	if err != nil {
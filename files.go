@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 
 	"github.com/go-chi/chi"
@@ -15,8 +18,96 @@ type RichFile struct {
 	wfs.File
 	Favorite bool  `json:"star,omitempty"`
 	Users    []int `json:"users,omitempty"`
+	Link     bool  `json:"link,omitempty"`
+	// direct or inherited from one of parent folders
+	Share   string `json:"share,omitempty"`
+	Snippet string `json:"snippet,omitempty"`
+	// last access of the current user, for recent files only
+	Accessed int64 `json:"accessed,omitempty"`
+	// days till removal from the trash
+	Purge *int `json:"purge,omitempty"`
 }
 
+// FilesPage is a part of the listing, compatible with dynamic loading of Webix components
+type FilesPage struct {
+	Data  []RichFile `json:"data"`
+	Pos   int        `json:"pos"`
+	Total int        `json:"total_count"`
+}
+
+// ListParams contains sorting and pagination options of the listing
+type ListParams struct {
+	Sort   string
+	Dir    string
+	Limit  int
+	Offset int
+}
+
+var sortColumns = map[string]string{
+	"name": "LOWER(name)",
+	"date": "modified",
+	"size": "size",
+	"type": "LOWER(IF(LOCATE('.', name) > 0, SUBSTRING_INDEX(name, '.', -1), ''))",
+}
+
+func getListParams(r *http.Request) (*ListParams, error) {
+	query := r.URL.Query()
+	list := &ListParams{Sort: query.Get("sort"), Dir: strings.ToLower(query.Get("dir"))}
+
+	if _, ok := sortColumns[list.Sort]; list.Sort != "" && !ok {
+		return nil, errors.New("incorrect sort value")
+	}
+	if list.Dir != "" && list.Dir != "asc" && list.Dir != "desc" {
+		return nil, errors.New("incorrect dir value")
+	}
+
+	var err error
+	if limit := query.Get("limit"); limit != "" {
+		list.Limit, err = strconv.Atoi(limit)
+		if err != nil || list.Limit < 0 {
+			return nil, errors.New("incorrect limit value")
+		}
+	}
+	if offset := query.Get("offset"); offset != "" {
+		list.Offset, err = strconv.Atoi(offset)
+		if err != nil || list.Offset < 0 {
+			return nil, errors.New("incorrect offset value")
+		}
+	}
+
+	return list, nil
+}
+
+// Custom checks if sorting or pagination differs from defaults
+func (l *ListParams) Custom() bool {
+	return l.Sort != "" || l.Dir != "" || l.Limit > 0 || l.Offset > 0
+}
+
+// OrderBy returns sql order, folders are always placed before files
+func (l *ListParams) OrderBy(def string) string {
+	if l.Sort == "" {
+		if l.Dir == "" {
+			return def
+		}
+		l.Sort = "name"
+	}
+
+	dir := "asc"
+	if l.Dir != "" {
+		dir = l.Dir
+	}
+
+	return "type desc, " + sortColumns[l.Sort] + " " + dir + ", LOWER(name) asc"
+}
+
+// files starred by the user, which are still in the own tree or shared with the user
+const favoriteSQL = `select ` + entityFields + ` from entity
+inner join favorite on favorite.entity_id = entity.id and favorite.user_id = ?
+where path != "/" and left(path, 1) != "." and (entity.tree = ? or exists (
+	select 1 from entity_user inner join entity shared on shared.id = entity_user.entity_id
+	where entity_user.user_id = ? and shared.tree = entity.tree
+	and (shared.path = entity.path or shared.path = "/" or LEFT(entity.path, char_length(shared.path) + 1) = concat(shared.path, "/"))))`
+
 func addFilesRoutes(r chi.Router) {
 
 	r.Get("/files", func(w http.ResponseWriter, r *http.Request) {
@@ -25,58 +116,72 @@ func addFilesRoutes(r chi.Router) {
 			id = "/"
 		}
 		source := r.URL.Query().Get("source")
+		search := r.URL.Query().Get("search")
+		user := getUser(r)
+		drive := user.Drive
+
+		list, err := getListParams(r)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
 
 		var data []wfs.File
-		var err error
+		total := 0
 
 		if source != "" {
 			switch source {
 			case "recent":
-				data, err = getFromQuery("select entity.* from entity where tree = ? and path != \"/\" and left(path, 1) !=\".\" order by type desc, modified desc, name asc limit 20", User.Root)
+				// without pagination only the last changes are shown
+				if list.Limit == 0 {
+					list.Limit = 20
+				}
+				data, total, err = getPage(user.Root, list, recentSQL, "recent.accessed desc", user.ID, user.Root, user.ID)
 			case "favorite":
-				data, err = getFromQuery("select entity.* from entity inner join favorite on entity.id = favorite.entity_id where tree = ? and path != \"/\" and left(path, 1) !=\".\" order by type desc, name asc", User.Root)
+				data, total, err = getPage(user.Root, list, favoriteSQL, "type desc, name asc", user.ID, user.Root, user.ID)
 			case "shared":
-				data, err = getFromQuery("select entity.* from entity inner join entity_user on entity.id = entity_user.entity_id where user_id = ? and tree = ? and path != \"/\" and left(path, 1) !=\".\" order by type desc, name asc", User.ID, User.Root)
+				data, total, err = getPage(user.Root, list, "select "+entityFields+" from entity inner join entity_user on entity.id = entity_user.entity_id where user_id = ? and tree != ? and path != \"/\" and left(path, 1) !=\".\"", "type desc, name asc", user.ID, user.Root)
 			case "trash":
-				data, err = getFromQuery("select entity.* from entity where left(path,1) = \".\" AND tree = ? AND folder = -1 order by type desc, name asc", User.Root)
+				data, total, err = getPage(user.Root, list, "select "+entityFields+" from entity where left(path,1) = \".\" AND tree = ? AND folder = -1", "type desc, name asc", user.Root)
+			default:
+				// saved search, the query is executed on each request
+				if strings.HasPrefix(source, "saved:") {
+					saved := SavedSearch{}
+					err = conn.Get(&saved, "SELECT id, name, query, folder FROM saved_search WHERE id = ? AND user_id = ?", source[6:], user.ID)
+					if err != nil {
+						format.Text(w, 500, "Access Denied")
+						return
+					}
+
+					search = saved.Query
+					if !hasAccess(user, dbID(saved.Folder, user), ViewerAccess) {
+						format.Text(w, 500, "Access Denied")
+						return
+					}
+					data, total, err = searchFiles(user, saved.Folder, search, list)
+				}
 			}
 		} else {
-			search := r.URL.Query().Get("search")
-
 			var config *wfs.ListConfig
-			if search == "" {
+			if search == "" && !list.Custom() {
 				config = &wfs.ListConfig{
 					Nested:  true,
 					Exclude: func(name string) bool { return strings.HasPrefix(name, ".") },
 				}
 				data, err = drive.List(id, config)
-			} else {
-				names, tags := processInput(search)
-				searchBy := "WHERE tree = ? AND path LIKE ?"
-				params := make([]interface{}, len(names)+2)
-				params[0] = User.Root
-				if id == "/" {
-					params[1] = "/%"
-				} else {
-					params[1] = id + "/%"
-				}
-
-				for i := range names {
-					params[i+2] = "%" + names[i] + "%"
-					searchBy += " AND name LIKE ?"
-				}
-				if len(tags) > 0 {
-					tsql, targs, _ := sqlx.In("WHERE tag.value IN (?)", tags)
-					searchBy += ` AND id IN (
-						SELECT entity_id FROM entity_tag 
-						INNER JOIN tag ON tag.id = entity_tag.tag_id ` + tsql + `) `
-					params = append(params, targs...)
+			} else if search == "" {
+				did := dbID(id, user)
+				if !hasAccess(user, did, ViewerAccess) {
+					format.Text(w, 500, "Access Denied")
+					return
 				}
-
-				if len(params) > 2 {
-					data, err = getFromQuery(`
-						SELECT entity.* FROM entity `+searchBy, params...)
+				data, total, err = getPage(user.Root, list, "select "+entityFields+" from entity where folder = ? and left(name, 1) != \".\"", "type desc, LOWER(name) asc", did)
+			} else {
+				if !hasAccess(user, dbID(id, user), ViewerAccess) {
+					format.Text(w, 500, "Access Denied")
+					return
 				}
+				data, total, err = searchFiles(user, id, search, list)
 			}
 		}
 
@@ -85,7 +190,23 @@ func addFilesRoutes(r chi.Router) {
 			return
 		}
 
-		err = format.JSON(w, 200, enrich(data, conn))
+		files := enrich(data, user, conn)
+		if search != "" {
+			addSnippets(files, user, search)
+		}
+		if source == "recent" {
+			addAccessTime(files, user)
+		}
+		if source == "trash" {
+			addPurgeDays(files, user)
+		}
+
+		// a page is returned whenever the list was limited, including the default limit of recent files
+		if list.Limit > 0 {
+			err = format.JSON(w, 200, FilesPage{Data: files, Pos: list.Offset, Total: total})
+		} else {
+			err = format.JSON(w, 200, files)
+		}
 	})
 
 }
@@ -93,9 +214,32 @@ func addFilesRoutes(r chi.Router) {
 type UserShare struct {
 	UserID     int    `db:"user_id"`
 	EntityPath string `db:"path"`
+	Tree       int    `db:"tree"`
+}
+
+// getPage runs the query with sorting and pagination, the query must not contain ORDER BY
+// the total count of records is calculated only for queries with a limit
+func getPage(root int, list *ListParams, sql, order string, args ...interface{}) ([]wfs.File, int, error) {
+	total := 0
+	if list.Limit > 0 {
+		err := conn.Get(&total, "SELECT count(*) FROM ("+sql+") AS page", args...)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	sql += " ORDER BY " + list.OrderBy(order)
+	if list.Limit > 0 {
+		sql += " LIMIT " + strconv.Itoa(list.Limit) + " OFFSET " + strconv.Itoa(list.Offset)
+	} else if list.Offset > 0 {
+		sql += " LIMIT 18446744073709551615 OFFSET " + strconv.Itoa(list.Offset)
+	}
+
+	data, err := getFromQuery(root, sql, args...)
+	return data, total, err
 }
 
-func getFromQuery(sql string, args ...interface{}) ([]wfs.File, error) {
+func getFromQuery(root int, sql string, args ...interface{}) ([]wfs.File, error) {
 	data := make([]db.DBFile, 0)
 
 	err := conn.Select(&data, sql, args...)
@@ -105,48 +249,89 @@ func getFromQuery(sql string, args ...interface{}) ([]wfs.File, error) {
 
 	out := make([]wfs.File, len(data))
 	for i, d := range data {
-		out[i] = wfs.File{ID: d.Path, Name: d.FileName, Date: d.LastModTime.Unix(), Size: d.FileSize, Type: wfs.GetType(d.FileName, d.IsDir())}
+		out[i] = wfs.File{ID: clientID(d.Tree, d.Path, root), Name: d.FileName, Date: d.LastModTime.Unix(), Size: d.FileSize, Type: wfs.GetType(d.FileName, d.IsDir())}
 	}
 
 	return out, nil
 }
 
-func enrich(data []wfs.File, db *sqlx.DB) []RichFile {
+func enrich(data []wfs.File, user *CurrentUser, db *sqlx.DB) []RichFile {
 	rfiles := make([]RichFile, len(data))
-	ids := make([]string, 0, len(data))
+	paths := make([]string, 0, len(data))
+	trees := []int{user.Root}
 	temp := make(map[string]*RichFile)
 
 	for i := range data {
 		rfiles[i] = RichFile{File: data[i]}
-		ids = append(ids, data[i].ID)
+		tree, path := parseID(data[i].ID, user.Root)
+		paths = append(paths, path)
+		if tree != user.Root {
+			trees = append(trees, tree)
+		}
 		temp[data[i].ID] = &rfiles[i]
 	}
 
-	favs := make([]string, 0)
+	favs := make([]UserShare, 0)
 	query, args, _ := sqlx.In(`
-SELECT entity.path FROM entity 
+SELECT entity.path, entity.tree, favorite.user_id FROM entity 
 INNER JOIN favorite ON entity.id = favorite.entity_id 
-WHERE entity.path IN (?)  AND favorite.user_id = ? AND tree = ?`, ids, User.ID, User.Root)
+WHERE entity.path IN (?)  AND favorite.user_id = ? AND tree IN (?)`, paths, user.ID, trees)
 	err := db.Select(&favs, query, args...)
 	if err != nil {
 		log.Print(err.Error())
 	}
 
+	// shares of listed files and of their parent folders, in the own tree and in other trees for the user
+	parents := make(map[string]bool)
+	for _, p := range paths {
+		parents[p] = true
+		for _, parent := range parentPaths(p) {
+			parents[parent] = true
+		}
+	}
+	sharedPaths := make([]string, 0, len(parents))
+	for p := range parents {
+		sharedPaths = append(sharedPaths, p)
+	}
+
 	users := make([]UserShare, 0)
 	query, args, _ = sqlx.In(`
-SELECT entity.path, entity_user.user_id 
+SELECT entity.path, entity.tree, entity_user.user_id 
 FROM entity INNER JOIN entity_user ON entity.id = entity_user.entity_id
-WHERE entity.path IN (?) AND tree = ?`, ids, User.Root)
+WHERE entity.path IN (?) AND (tree = ? OR (tree IN (?) AND entity_user.user_id = ?))`, sharedPaths, user.Root, trees, user.ID)
 	err = db.Select(&users, query, args...)
 	if err != nil {
 		log.Print(err.Error())
 	}
+	links := make([]UserShare, 0)
+	query, args, _ = sqlx.In(`
+SELECT DISTINCT entity.path, entity.tree
+FROM entity INNER JOIN share_link ON entity.id = share_link.entity_id
+WHERE entity.path IN (?) AND tree IN (?)
+AND (expires IS NULL OR expires > now()) AND (max_downloads = 0 OR downloads < max_downloads)`, paths, trees)
+	err = db.Select(&links, query, args...)
+	if err != nil {
+		log.Print(err.Error())
+	}
+	for _, l := range links {
+		if t, ok := temp[clientID(l.Tree, l.EntityPath, user.Root)]; ok {
+			t.Link = true
+		}
+	}
+
 	for _, f := range favs {
-		temp[f].Favorite = true
+		if t, ok := temp[clientID(f.Tree, f.EntityPath, user.Root)]; ok {
+			t.Favorite = true
+		}
 	}
 
+	shared := make(map[string]bool)
 	for _, u := range users {
-		t := temp[u.EntityPath]
+		shared[clientID(u.Tree, u.EntityPath, user.Root)] = true
+		t, ok := temp[clientID(u.Tree, u.EntityPath, user.Root)]
+		if !ok {
+			continue
+		}
 		if t.Users == nil {
 			t.Users = []int{u.UserID}
 		} else {
@@ -154,21 +339,30 @@ WHERE entity.path IN (?) AND tree = ?`, ids, User.Root)
 		}
 	}
 
-	return rfiles
-}
-
-func processInput(inp string) (names, tags []string) {
-	words := strings.Fields(inp)
+	for i := range rfiles {
+		if shared[rfiles[i].ID] {
+			rfiles[i].Share = "direct"
+			continue
+		}
 
-	for _, w := range words {
-		if strings.HasPrefix(w, "#") {
-			if len(w) > 1 {
-				tags = append(tags, strings.TrimLeft(w, "#"))
+		tree, path := parseID(rfiles[i].ID, user.Root)
+		for _, parent := range parentPaths(path) {
+			if shared[clientID(tree, parent, user.Root)] {
+				rfiles[i].Share = "inherited"
+				break
 			}
-		} else {
-			names = append(names, w)
 		}
 	}
 
-	return
+	return rfiles
+}
+
+// parentPaths returns paths of all folders which contain the path, up to the root
+func parentPaths(p string) []string {
+	out := make([]string, 0)
+	for p != "/" && p != "." && p != "" {
+		p = path.Dir(p)
+		out = append(out, p)
+	}
+	return out
 }
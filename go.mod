@@ -16,5 +16,5 @@ require (
 	github.com/unrolled/render v1.0.2
 	github.com/xbsoftware/wfs v0.0.0-20200826093531-5710d5a7e63b
 	github.com/xbsoftware/wfs-db v0.0.0-20200304161452-662f70426b5e
-	golang.org/x/net v0.0.0-20200319234117-63522dbf7eec // indirect
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
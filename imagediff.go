@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+)
+
+// ImageDiff contains the share of changed pixels and generated images as data urls
+type ImageDiff struct {
+	Changed   float64 `json:"changed"`
+	Pixels    int     `json:"pixels"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Diff      string  `json:"diff"`
+	Composite string  `json:"composite"`
+}
+
+// max difference of a color channel for unchanged pixels
+const imageDiffThreshold = 8
+
+// max number of pixels in compared images
+const maxImageDiffPixels = 25 * 1000 * 1000
+
+// max number of pixels in the composite, it contains both versions and the diff
+const maxImageCompositePixels = 80 * 1000 * 1000
+
+const compositeGap = 10
+
+var changedPixel = color.NRGBA{R: 255, A: 255}
+
+// serveImageDiff sends the image with highlighted changes between two versions of an image
+// or the side by side composite of both versions and the diff
+func serveImageDiff(w http.ResponseWriter, r *http.Request, did int, content, previous string) {
+	// the version can be compared with the other version or with the current file
+	with := r.URL.Query().Get("with")
+	if with == "current" {
+		conn.Get(&previous, "SELECT content FROM entity WHERE id = ?", did)
+	} else if with != "" {
+		err := conn.Get(&previous, "SELECT content FROM entity_edit WHERE id = ? AND entity_id = ?", with, did)
+		if err != nil {
+			format.Text(w, 500, "wrong version of the file")
+			return
+		}
+	}
+	if previous == "" {
+		format.Text(w, 500, "there is no version to compare with")
+		return
+	}
+
+	before, err := loadVersionImage(previous)
+	if err != nil {
+		format.Text(w, 500, err.Error())
+		return
+	}
+	after, err := loadVersionImage(content)
+	if err != nil {
+		format.Text(w, 500, err.Error())
+		return
+	}
+
+	asJSON := r.URL.Query().Get("format") == "json"
+	err = checkImageDiffSize(before, after, asJSON || r.URL.Query().Get("view") == "composite")
+	if err != nil {
+		format.Text(w, 500, err.Error())
+		return
+	}
+
+	diff, changed := diffImages(before, after)
+
+	if asJSON {
+		size := diff.Bounds().Size()
+		info := ImageDiff{
+			Changed:   float64(changed) * 100 / float64(size.X*size.Y),
+			Pixels:    changed,
+			Width:     size.X,
+			Height:    size.Y,
+			Diff:      imageDataURL(diff),
+			Composite: imageDataURL(compositeImages(before, after, diff)),
+		}
+		format.JSON(w, 200, info)
+		return
+	}
+
+	out := diff
+	if r.URL.Query().Get("view") == "composite" {
+		out = compositeImages(before, after, diff)
+	}
+
+	w.Header().Set("Content-type", "image/png")
+	imaging.Encode(w, out, imaging.PNG)
+}
+
+func loadVersionImage(content string) (image.Image, error) {
+	file, err := os.Open(filepath.Join(Config.DataFolder, content))
+	if err != nil {
+		return nil, errors.New("Can't open file for reading")
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, errors.New("the version is not an image")
+	}
+	if config.Width*config.Height > maxImageDiffPixels {
+		return nil, errors.New("the image is too large")
+	}
+
+	file.Seek(0, 0)
+	return imaging.Decode(file)
+}
+
+// checkImageDiffSize rejects images, which canvas or composite are too large to allocate
+// each image fits the limit, but the common canvas of a wide and a tall image may not
+func checkImageDiffSize(before, after image.Image, composite bool) error {
+	a, b := before.Bounds().Size(), after.Bounds().Size()
+
+	width, height := a.X, a.Y
+	if b.X > width {
+		width = b.X
+	}
+	if b.Y > height {
+		height = b.Y
+	}
+	if int64(width)*int64(height) > maxImageDiffPixels {
+		return errors.New("the images are too large to compare")
+	}
+
+	if composite {
+		// old version, new version and the diff with gaps between them
+		compositeWidth := a.X + b.X + width + compositeGap*2
+		if int64(compositeWidth)*int64(height) > maxImageCompositePixels {
+			return errors.New("the images are too large to compare")
+		}
+	}
+
+	return nil
+}
+
+// diffImages marks changed pixels by red color over the faded new image
+// images of different sizes are compared on the common canvas
+func diffImages(before, after image.Image) (*image.NRGBA, int) {
+	a := imaging.Clone(before)
+	b := imaging.Clone(after)
+
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	if b.Bounds().Dx() > width {
+		width = b.Bounds().Dx()
+	}
+	if b.Bounds().Dy() > height {
+		height = b.Bounds().Dy()
+	}
+
+	out := image.NewNRGBA(image.Rect(0, 0, width, height))
+	changed := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ca := a.NRGBAAt(x, y)
+			cb := b.NRGBAAt(x, y)
+			if !image.Pt(x, y).In(a.Bounds()) || !image.Pt(x, y).In(b.Bounds()) || colorChanged(ca, cb) {
+				out.SetNRGBA(x, y, changedPixel)
+				changed++
+				continue
+			}
+
+			gray := (299*int(cb.R) + 587*int(cb.G) + 114*int(cb.B)) / 1000
+			faded := uint8(255 - (255-gray)/3)
+			out.SetNRGBA(x, y, color.NRGBA{R: faded, G: faded, B: faded, A: 255})
+		}
+	}
+
+	return out, changed
+}
+
+func colorChanged(a, b color.NRGBA) bool {
+	return channelDiff(a.R, b.R) > imageDiffThreshold || channelDiff(a.G, b.G) > imageDiffThreshold ||
+		channelDiff(a.B, b.B) > imageDiffThreshold || channelDiff(a.A, b.A) > imageDiffThreshold
+}
+
+func channelDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// compositeImages places old version, new version and the diff side by side
+func compositeImages(before, after, diff image.Image) *image.NRGBA {
+	parts := []image.Image{before, after, diff}
+
+	width, height := compositeGap*(len(parts)-1), 0
+	for _, p := range parts {
+		width += p.Bounds().Dx()
+		if p.Bounds().Dy() > height {
+			height = p.Bounds().Dy()
+		}
+	}
+
+	out := imaging.New(width, height, color.White)
+	x := 0
+	for _, p := range parts {
+		out = imaging.Paste(out, p, image.Pt(x, 0))
+		x += p.Bounds().Dx() + compositeGap
+	}
+
+	return out
+}
+
+func imageDataURL(img image.Image) string {
+	var buff bytes.Buffer
+	imaging.Encode(&buff, img, imaging.PNG)
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buff.Bytes())
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/xbsoftware/wfs"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type LinkInfo struct {
+	ID        int        `json:"id"`
+	Token     string     `json:"token"`
+	EntityID  int        `db:"entity_id" json:"-"`
+	UserID    int        `db:"user_id" json:"user"`
+	Password  string     `json:"-"`
+	Protected bool       `db:"-" json:"protected"`
+	Expires   *time.Time `json:"expires"`
+	Limit     int        `db:"max_downloads" json:"limit"`
+	Downloads int        `json:"downloads"`
+}
+
+var dateLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+func parseDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return &t, nil
+		}
+	}
+
+	return nil, errors.New("wrong date format")
+}
+
+func addLinkRoutes(r chi.Router) {
+	r.Get("/links", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		did := dbID(r.URL.Query().Get("id"), user)
+		if !hasAccess(user, did, OwnerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		links := make([]LinkInfo, 0)
+		err := conn.Select(&links, "SELECT id, token, entity_id, user_id, password, expires, max_downloads, downloads FROM share_link WHERE entity_id = ?", did)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		for i := range links {
+			links[i].Protected = links[i].Password != ""
+		}
+		format.JSON(w, 200, links)
+	})
+
+	r.Post("/links", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		r.ParseForm()
+		did := dbID(r.Form.Get("id"), user)
+		if !hasAccess(user, did, OwnerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		link := LinkInfo{EntityID: did, UserID: user.ID}
+
+		var err error
+		link.Expires, err = parseDate(r.Form.Get("expires"))
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		if limit := r.Form.Get("limit"); limit != "" {
+			link.Limit, err = strconv.Atoi(limit)
+			if err != nil || link.Limit < 0 {
+				format.Text(w, 500, "incorrect limit value")
+				return
+			}
+		}
+
+		if password := r.Form.Get("password"); password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				format.Text(w, 500, err.Error())
+				return
+			}
+			link.Password = string(hash)
+			link.Protected = true
+		}
+
+		link.Token, err = newToken()
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		res, err := conn.Exec("INSERT INTO share_link(token, entity_id, user_id, password, expires, max_downloads) VALUES(?, ?, ?, ?, ?, ?)",
+			link.Token, link.EntityID, link.UserID, link.Password, link.Expires, link.Limit)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		lid, _ := res.LastInsertId()
+		link.ID = int(lid)
+		format.JSON(w, 200, link)
+	})
+
+	r.Delete("/links/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		id := chi.URLParam(r, "id")
+
+		var did int
+		conn.Get(&did, "SELECT entity_id FROM share_link WHERE id = ?", id)
+		if !hasAccess(user, did, OwnerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		conn.Exec("DELETE FROM share_link WHERE id = ?", id)
+		format.JSON(w, 200, Response{ID: id})
+	})
+}
+
+// LinkTarget is a file requested through a public link
+type LinkTarget struct {
+	Link  *LinkInfo
+	Drive wfs.Drive
+	// id of the shared entity in the drive of the link's author
+	Root string
+	// id of the requested file
+	ID string
+}
+
+// addPublicLinkRoutes adds routes which are available without authentication
+// password of protected links is sent by POST or in the X-Link-Password header, so it isn't logged with the url
+func addPublicLinkRoutes(r chi.Router) {
+	r.Get("/s/{token}", serveLink)
+	r.Post("/s/{token}", serveLink)
+	r.Get("/s/{token}/preview", serveLinkPreview)
+	r.Post("/s/{token}/preview", serveLinkPreview)
+}
+
+func serveLink(w http.ResponseWriter, r *http.Request) {
+	target, ok := openLink(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := target.Drive.Info(target.ID)
+	if err != nil {
+		format.Text(w, 500, "Access denied")
+		return
+	}
+
+	if info.Type == "folder" {
+		data, err := target.Drive.List(target.ID, &wfs.ListConfig{
+			Nested:  true,
+			Exclude: func(name string) bool { return strings.HasPrefix(name, ".") },
+		})
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		// do not expose location of the shared folder
+		for i := range data {
+			data[i].ID = strings.TrimPrefix(data[i].ID, target.Root)
+		}
+		format.JSON(w, 200, data)
+		return
+	}
+
+	if target.Link.Limit > 0 && target.Link.Downloads >= target.Link.Limit {
+		format.Text(w, 403, "Download limit reached")
+		return
+	}
+
+	// only a full transfer of the file is counted as a download, range requests are not
+	tw := &transferWriter{ResponseWriter: w}
+	if serveDirect(tw, r, target.Drive, target.ID) && tw.status == http.StatusOK && tw.written == info.Size {
+		conn.Exec("UPDATE share_link SET downloads = downloads + 1 WHERE id = ?", target.Link.ID)
+	}
+}
+
+func serveLinkPreview(w http.ResponseWriter, r *http.Request) {
+	target, ok := openLink(w, r)
+	if !ok {
+		return
+	}
+
+	var tree int
+	conn.Get(&tree, "SELECT tree FROM entity WHERE id = ?", target.Link.EntityID)
+	_, p := parseID(target.ID, tree)
+
+	serveFilePreview(w, r, target.Drive, target.ID, previewKey(tree, p))
+}
+
+// transferWriter tracks the status and the size of the response
+type transferWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (t *transferWriter) WriteHeader(code int) {
+	t.status = code
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *transferWriter) Write(data []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	n, err := t.ResponseWriter.Write(data)
+	t.written += int64(n)
+	return n, err
+}
+
+func linkPassword(r *http.Request) string {
+	if password := r.Header.Get("X-Link-Password"); password != "" {
+		return password
+	}
+	return r.PostFormValue("password")
+}
+
+// openLink validates the link from the request and resolves the requested file
+func openLink(w http.ResponseWriter, r *http.Request) (*LinkTarget, bool) {
+	link := LinkInfo{}
+	err := conn.Get(&link, `SELECT id, token, entity_id, user_id, password, expires, max_downloads, downloads FROM share_link
+		WHERE token = ? AND (expires IS NULL OR expires > now())`, chi.URLParam(r, "token"))
+	if err != nil {
+		format.Text(w, 404, "Link not found")
+		return nil, false
+	}
+
+	if link.Password != "" {
+		err = bcrypt.CompareHashAndPassword([]byte(link.Password), []byte(linkPassword(r)))
+		if err != nil {
+			format.Text(w, 401, "Wrong password")
+			return nil, false
+		}
+	}
+
+	var info struct {
+		Path string
+		Tree int
+	}
+	err = conn.Get(&info, "SELECT path, tree FROM entity WHERE id = ?", link.EntityID)
+	if err != nil || strings.HasPrefix(info.Path, ".") {
+		format.Text(w, 404, "Link not found")
+		return nil, false
+	}
+
+	root, err := getUserRoot(link.UserID)
+	if err != nil {
+		format.Text(w, 404, "Link not found")
+		return nil, false
+	}
+
+	target := &LinkTarget{
+		Link:  &link,
+		Drive: getDrive(&CurrentUser{ID: link.UserID, Root: root}),
+		Root:  clientID(info.Tree, info.Path, root),
+	}
+
+	// files inside of the shared folder
+	target.ID = target.Root
+	if sub := r.URL.Query().Get("id"); sub != "" && sub != "/" {
+		target.ID = path.Join(target.Root, path.Clean("/"+sub))
+	}
+
+	return target, true
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/dhowden/tag"
 	"github.com/rwcarlsen/goexif/exif"
 	"github.com/rwcarlsen/goexif/tiff"
+	"github.com/xbsoftware/wfs"
 	"net/http"
 	"strconv"
 )
@@ -22,6 +23,7 @@ func getMetaInfo(w http.ResponseWriter, r *http.Request) {
 		panic("id not provided")
 	}
 
+	drive := getUser(r).Drive
 	info, err := drive.Info(id)
 	if err != nil {
 		format.JSON(w, 500, Response{Invalid: true, Error: "Access denied"})
@@ -30,9 +32,9 @@ func getMetaInfo(w http.ResponseWriter, r *http.Request) {
 
 	var meta interface{}
 	if info.Type == "audio" {
-		meta, err = getMusicMetaInfo(id)
+		meta, err = getMusicMetaInfo(drive, id)
 	} else if info.Type == "image" {
-		meta, err = getImageMetaInfo(id)
+		meta, err = getImageMetaInfo(drive, id)
 	} else {
 		meta = nil
 	}
@@ -44,7 +46,7 @@ func getMetaInfo(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getMusicMetaInfo(id string) (MusicMeta, error) {
+func getMusicMetaInfo(drive wfs.Drive, id string) (MusicMeta, error) {
 	content, err := drive.Read(id)
 	if err != nil {
 		return MusicMeta{}, err
@@ -64,7 +66,7 @@ func getMusicMetaInfo(id string) (MusicMeta, error) {
 	}, nil
 }
 
-func getImageMetaInfo(id string) (map[exif.FieldName]string, error) {
+func getImageMetaInfo(drive wfs.Drive, id string) (map[exif.FieldName]string, error) {
 	data, err := drive.Read(id)
 	if err != nil {
 		return nil, err
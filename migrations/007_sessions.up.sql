@@ -0,0 +1,6 @@
+create table session
+(
+    token   varchar(64)     primary key,
+    user_id int             not null,
+    expires datetime        null
+);
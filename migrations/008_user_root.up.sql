@@ -0,0 +1,5 @@
+alter table user add column root int default 0 not null;
+update user set root = 1 where id = 1;
+
+create index entity_tree_path_index
+    on entity (tree, path(255));
@@ -0,0 +1,4 @@
+alter table entity_user add column access tinyint default 1 not null;
+
+-- shares created before access levels had full access
+update entity_user set access = 3;
@@ -0,0 +1,18 @@
+create table share_link
+(
+    id              int auto_increment          primary key,
+    token           varchar(64)                 not null,
+    entity_id       int                         not null,
+    user_id         int                         not null,
+    password        varchar(60) default ''      not null,
+    expires         datetime                    null,
+    max_downloads   int         default 0       not null,
+    downloads       int         default 0       not null,
+    created         datetime    default now()   not null
+);
+
+create unique index share_link_token_index
+    on share_link (token);
+
+create index share_link_entity_index
+    on share_link (entity_id);
@@ -0,0 +1,6 @@
+create table entity_text
+(
+    entity_id   int             primary key,
+    content     mediumtext      not null,
+    fulltext index entity_text_content_index (content)
+) engine = InnoDB;
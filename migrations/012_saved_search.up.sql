@@ -0,0 +1,11 @@
+create table saved_search
+(
+    id          int auto_increment      primary key,
+    user_id     int                     not null,
+    name        varchar(255)            not null,
+    query       varchar(1024)           not null,
+    folder      varchar(2048)           not null
+);
+
+create index saved_search_user_index
+    on saved_search (user_id);
@@ -0,0 +1,10 @@
+create table access_log
+(
+    id          int auto_increment      primary key,
+    user_id     int                     not null,
+    entity_id   int                     not null,
+    accessed    datetime                not null
+);
+
+create index access_log_user_index
+    on access_log (user_id, entity_id, accessed);
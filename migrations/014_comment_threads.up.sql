@@ -0,0 +1,29 @@
+alter table comment
+    modify content text null;
+
+alter table comment
+    add parent_id int default 0 not null;
+
+alter table comment
+    add resolved tinyint default 0 not null;
+
+alter table comment
+    add resolved_by int default 0 not null;
+
+alter table comment
+    add resolved_date datetime null;
+
+create index comment_entity_index
+    on comment (entity_id);
+
+create table comment_mention
+(
+    id          int auto_increment      primary key,
+    comment_id  int                     not null,
+    entity_id   int                     not null,
+    user_id     int                     not null,
+    is_read     tinyint default 0       not null
+);
+
+create index comment_mention_user_index
+    on comment_mention (user_id, is_read);
@@ -0,0 +1,11 @@
+alter table comment
+    add edit_id int default 0 not null;
+
+alter table comment
+    add anchor_unit varchar(8) default '' not null;
+
+alter table comment
+    add anchor_from int null;
+
+alter table comment
+    add anchor_to int null;
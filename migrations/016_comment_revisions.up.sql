@@ -0,0 +1,24 @@
+alter table comment
+    add edited datetime null;
+
+alter table comment
+    add deleted datetime null;
+
+alter table comment
+    add deleted_by int default 0 not null;
+
+create table comment_revision
+(
+    id          int auto_increment      primary key,
+    comment_id  int                     not null,
+    user_id     int                     not null,
+    content     text                    null,
+    deleted     tinyint default 0       not null,
+    modified    datetime                not null
+);
+
+create index comment_revision_comment_index
+    on comment_revision (comment_id);
+
+insert into comment_revision(comment_id, user_id, content, modified)
+    select id, user_id, content, COALESCE(modified, now()) from comment;
@@ -0,0 +1,8 @@
+alter table entity_edit
+    add label varchar(255) default '' not null;
+
+alter table entity_edit
+    add description text null;
+
+alter table entity_edit
+    add pinned tinyint default 0 not null;
@@ -0,0 +1,10 @@
+alter table entity_edit
+    add event varchar(16) default 'content' not null;
+
+alter table entity_edit
+    add old_path varchar(767) default '' not null;
+
+alter table entity_edit
+    add new_path varchar(767) default '' not null;
+
+update entity_edit set event = 'restore-version' where origin is not null;
@@ -0,0 +1,15 @@
+alter table entity
+    modify content varchar(64) default '' not null;
+
+alter table entity_edit
+    modify content varchar(64) default '' not null;
+
+alter table entity_edit
+    modify previous varchar(64) default '' not null;
+
+create table content_blob
+(
+    hash        varchar(64)             primary key,
+    size        bigint                  not null,
+    refs        int default 0           not null
+);
@@ -0,0 +1,4 @@
+alter table entity
+    add deleted datetime null;
+
+update entity set deleted = now() where folder = -1;
@@ -0,0 +1,5 @@
+update content_blob set refs = greatest(refs - (
+    select count(*) from entity_edit
+    where entity_edit.content = content_blob.hash and entity_edit.event not in ('content', 'restore-version')), 0);
+
+update entity_edit set content = '', previous = '' where event not in ('content', 'restore-version');
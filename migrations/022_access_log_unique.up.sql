@@ -0,0 +1,12 @@
+delete older from access_log older
+inner join access_log newer
+    on older.user_id = newer.user_id and older.entity_id = newer.entity_id
+    and (older.accessed < newer.accessed or older.accessed = newer.accessed and older.id < newer.id);
+
+drop index access_log_user_index on access_log;
+
+create unique index access_log_user_entity
+    on access_log (user_id, entity_id);
+
+create index access_log_user_accessed
+    on access_log (user_id, accessed);
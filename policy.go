@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/xbsoftware/wfs"
+)
+
+// access levels of a share
+const (
+	NoAccess int = iota
+	ViewerAccess
+	CommenterAccess
+	EditorAccess
+	OwnerAccess
+)
+
+var accessNames = map[string]int{
+	"viewer":    ViewerAccess,
+	"commenter": CommenterAccess,
+	"editor":    EditorAccess,
+	"owner":     OwnerAccess,
+}
+
+// SharePolicy allows full access to the user's own tree
+// and limits access to the files of other trees by the level of the share
+type SharePolicy struct {
+	User int
+	Root int
+}
+
+// Comply method returns true if the user's access level is enough for the operation
+func (p SharePolicy) Comply(f wfs.FileID, operation int) bool {
+	info := f.(FileID).File()
+	level := getAccessLevel(info.ID, info.Tree, info.Path, p.User, p.Root)
+
+	if operation == wfs.ReadOperation {
+		return level >= ViewerAccess
+	}
+	return level >= EditorAccess
+}
+
+// getAccessLevel returns the access level of the user to the entity
+// shares of a folder apply to everything beneath it
+func getAccessLevel(id, tree int, path string, uid, root int) int {
+	if id == 0 {
+		return NoAccess
+	}
+	if tree == root {
+		return OwnerAccess
+	}
+
+	level := NoAccess
+	conn.Get(&level, `SELECT COALESCE(max(entity_user.access), 0) FROM entity_user
+		INNER JOIN entity ON entity.id = entity_user.entity_id
+		WHERE entity_user.user_id = ? AND entity.tree = ?
+		AND (entity.path = ? OR entity.path = "/" OR LEFT(?, char_length(entity.path) + 1) = concat(entity.path, "/"))`,
+		uid, tree, path, path)
+	return level
+}
+
+// hasAccess checks the access level of the current user to the entity with the db id
+func hasAccess(user *CurrentUser, did, level int) bool {
+	var info struct {
+		Tree int
+		Path string
+	}
+	conn.Get(&info, "SELECT tree, path FROM entity WHERE id = ?", did)
+
+	return getAccessLevel(did, info.Tree, info.Path, user.ID, user.Root) >= level
+}
+
+// isInside checks that the path is the same as the folder or located inside of it
+func isInside(path, folder string) bool {
+	return path == folder || folder == "/" || strings.HasPrefix(path, folder+"/")
+}
@@ -50,12 +50,28 @@ func serveIconPreview(w http.ResponseWriter, r *http.Request, info wfs.File) {
 }
 
 func getFilePreview(w http.ResponseWriter, r *http.Request) {
+	user := getUser(r)
+	id := r.URL.Query().Get("id")
+	tree, path := parseID(id, user.Root)
+
+	serveFilePreview(w, r, user.Drive, id, previewKey(tree, path))
+}
+
+// previewKey returns the key of cached previews of the file, which is the hash of its content
+// so previews are shared by copies and aren't affected by renames
+func previewKey(tree int, path string) string {
+	var content string
+	conn.Get(&content, "SELECT content FROM entity WHERE path = ? AND tree = ?", path, tree)
+	return content
+}
+
+// serveFilePreview sends thumbnail of the file, previews are cached by the key
+func serveFilePreview(w http.ResponseWriter, r *http.Request, drive wfs.Drive, id, key string) {
 	if Config.Preview == "none" {
 		format.Text(w, 500, "Previews not configured")
 		return
 	}
 
-	id := r.URL.Query().Get("id")
 	info, err := drive.Info(id)
 	if err != nil {
 		format.Text(w, 500, "Access denied")
@@ -75,13 +91,13 @@ func getFilePreview(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if info.Size > 50*1000*1000 || width > 2000 || height > 2000 {
+	if key == "" || info.Size > 50*1000*1000 || width > 2000 || height > 2000 {
 		// file is too large, still it is a valid use-case so return some image
 		serveIconPreview(w, r, info)
 		return
 	}
 
-	target := getImagePreviewName(Config.DataFolder, id, widthStr, heightStr)
+	target := getImagePreviewName(Config.DataFolder, key, widthStr, heightStr)
 
 	// check previously generated preview
 	ext := ".jpg"
@@ -123,15 +139,30 @@ func getFilePreview(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, target+ext)
 }
 
-func getImagePreviewName(base, id, width, height string) string {
-	//folder := filepath.Join(base, filepath.Dir(id), ".preview")
-	err := os.MkdirAll("/tmp/preview", 0777)
+const previewFolder = "/tmp/preview"
+
+// previews of all sizes are stored in the folder of the key
+func getImagePreviewName(base, key, width, height string) string {
+	folder := filepath.Join(previewFolder, key)
+	err := os.MkdirAll(folder, 0777)
 	if err != nil {
 		log.Println("Can't create folder for previews")
 	}
-	return filepath.Join("/tmp/preview", width+"x"+height+"___"+strings.Replace(id, "/", "___", -1))
-	// return filepath.Join(folder, filepath.Base(id)+"___"+width+"x"+height)
+	return filepath.Join(folder, width+"x"+height)
 }
+
+// removePreviews deletes cached previews of all sizes for the key
+func removePreviews(key string) {
+	if key == "" {
+		return
+	}
+
+	err := os.RemoveAll(filepath.Join(previewFolder, key))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func getImagePreview(source io.Reader, target, name string, width, height int) (string, error) {
 	src, err := imaging.Decode(source)
 	if err != nil {
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/xbsoftware/wfs"
+	db "github.com/xbsoftware/wfs-db"
+)
+
+// SearchTerm is a single condition of the search query
+// plain words have an empty Key, tags use the "tag" key
+type SearchTerm struct {
+	Key    string
+	Value  string
+	Negate bool
+}
+
+type SearchQuery struct {
+	Terms []SearchTerm
+}
+
+// extensions of known file types, the type itself is resolved by wfs
+var knownExtensions = []string{
+	"docx", "doc", "odt", "xls", "xlsx", "ods", "pdf", "djvu", "djv", "pptx", "ppt",
+	"html", "htm", "js", "ts", "mjs", "json", "css", "scss", "sass", "less",
+	"php", "phtml", "php3", "php4", "php5", "php7", "php-s", "pht", "phar", "sh", "coffee",
+	"txt", "md", "go", "yml", "yaml", "xml", "sql", "sqlite3", "sqlite", "db",
+	"py", "pyc", "pyd", "pyo", "pyw", "pyz", "ini", "conf",
+	"mpg", "mp4", "avi", "mkv", "ogv",
+	"png", "jpg", "jpeg", "webp", "gif", "tiff", "tif", "svg",
+	"mp3", "ogg", "flac", "wav",
+	"zip", "rar", "7z", "tar", "gz",
+}
+
+var typeExtensions = make(map[string][]string)
+
+func init() {
+	for _, ext := range knownExtensions {
+		t := wfs.GetType("file."+ext, false)
+		typeExtensions[t] = append(typeExtensions[t], ext)
+	}
+}
+
+var sizeUnits = map[string]int64{"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30}
+
+var searchKeys = map[string]bool{
+	"type": true, "ext": true, "size": true, "modified": true,
+	"starred": true, "shared": true, "in": true,
+}
+
+// parseQuery splits the search string to terms
+// supported syntax: words, "quoted phrases", #tags, key:value filters and -negation
+func parseQuery(inp string) SearchQuery {
+	query := SearchQuery{}
+
+	for _, token := range splitQuery(inp) {
+		term := SearchTerm{}
+		if len(token) > 1 && token[0] == '-' {
+			term.Negate = true
+			token = token[1:]
+		}
+
+		if strings.HasPrefix(token, "#") {
+			if len(token) > 1 {
+				term.Key = "tag"
+				term.Value = strings.TrimLeft(token, "#")
+				query.Terms = append(query.Terms, term)
+			}
+			continue
+		}
+
+		if i := strings.Index(token, ":"); i > 0 && searchKeys[strings.ToLower(token[:i])] {
+			term.Key = strings.ToLower(token[:i])
+			token = token[i+1:]
+		}
+
+		term.Value = strings.Trim(token, "\"")
+		if term.Value != "" {
+			query.Terms = append(query.Terms, term)
+		}
+	}
+
+	return query
+}
+
+// splitQuery splits the string by spaces, spaces inside of quotes are preserved
+func splitQuery(inp string) []string {
+	tokens := make([]string, 0)
+
+	var token strings.Builder
+	quoted := false
+	for _, r := range inp {
+		if r == '"' {
+			quoted = !quoted
+		}
+
+		if unicode.IsSpace(r) && !quoted {
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+			continue
+		}
+		token.WriteRune(r)
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens
+}
+
+// Words returns plain words and phrases which must be present in the found files
+func (q SearchQuery) Words() []string {
+	words := make([]string, 0)
+	for _, t := range q.Terms {
+		if t.Key == "" && !t.Negate {
+			words = append(words, t.Value)
+		}
+	}
+
+	return words
+}
+
+// Where converts the query to the sql condition
+func (q SearchQuery) Where(user *CurrentUser) (string, []interface{}, error) {
+	where := make([]string, 0, len(q.Terms))
+	params := make([]interface{}, 0)
+
+	// positive tags are joined by OR
+	tags := make([]string, 0)
+	for _, t := range q.Terms {
+		if t.Key == "tag" && !t.Negate {
+			tags = append(tags, t.Value)
+		}
+	}
+	if len(tags) > 0 {
+		tsql, targs, _ := sqlx.In(`id IN (
+			SELECT entity_id FROM entity_tag
+			INNER JOIN tag ON tag.id = entity_tag.tag_id WHERE tag.value IN (?))`, tags)
+		where = append(where, tsql)
+		params = append(params, targs...)
+	}
+
+	for _, t := range q.Terms {
+		if t.Key == "tag" && !t.Negate {
+			continue
+		}
+
+		sql, args, err := t.where(user)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if t.Negate {
+			sql = "NOT (" + sql + ")"
+		}
+		where = append(where, sql)
+		params = append(params, args...)
+	}
+
+	return strings.Join(where, " AND "), params, nil
+}
+
+func (t SearchTerm) where(user *CurrentUser) (string, []interface{}, error) {
+	switch t.Key {
+	case "":
+		return `(name LIKE ? OR id IN (
+			SELECT entity_id FROM entity_text WHERE MATCH(content) AGAINST(? IN BOOLEAN MODE)))`,
+			[]interface{}{"%" + likeEscape.Replace(t.Value) + "%", fulltextPhrase(t.Value)}, nil
+
+	case "tag":
+		return `id IN (
+			SELECT entity_id FROM entity_tag
+			INNER JOIN tag ON tag.id = entity_tag.tag_id WHERE tag.value = ?)`, []interface{}{t.Value}, nil
+
+	case "type":
+		ftype := strings.ToLower(t.Value)
+		if ftype == "folder" {
+			return "type = ?", []interface{}{db.FolderRecord}, nil
+		}
+		if ftype == "file" {
+			sql, args, _ := sqlx.In("type = ? AND NOT ("+extensionSQL+")", db.FileRecord, knownExtensions)
+			return sql, args, nil
+		}
+
+		exts, ok := typeExtensions[ftype]
+		if !ok {
+			return "", nil, errors.New("unknown file type: " + t.Value)
+		}
+		sql, args, _ := sqlx.In("type = ? AND "+extensionSQL, db.FileRecord, exts)
+		return sql, args, nil
+
+	case "ext":
+		sql, args, _ := sqlx.In("type = ? AND "+extensionSQL, db.FileRecord, []string{strings.ToLower(strings.TrimPrefix(t.Value, "."))})
+		return sql, args, nil
+
+	case "size":
+		op, value := splitOperator(t.Value)
+		size, err := parseSize(value)
+		if err != nil {
+			return "", nil, err
+		}
+		return "size " + op + " ?", []interface{}{size}, nil
+
+	case "modified":
+		op, value := splitOperator(t.Value)
+		date, err := parseDate(value)
+		if err != nil || date == nil {
+			return "", nil, errors.New("wrong date: " + t.Value)
+		}
+
+		// the whole day for dates without time
+		if op == "=" {
+			return "modified >= ? AND modified < ?", []interface{}{*date, date.Add(24 * time.Hour)}, nil
+		}
+		return "modified " + op + " ?", []interface{}{*date}, nil
+
+	case "starred":
+		sql := "id IN (SELECT entity_id FROM favorite WHERE user_id = ?)"
+		if isNo(t.Value) {
+			sql = "NOT " + sql
+		}
+		return sql, []interface{}{user.ID}, nil
+
+	case "shared":
+		value := strings.ToLower(t.Value)
+		if strings.HasPrefix(value, "with:") {
+			who := t.Value[5:]
+			return `id IN (SELECT entity_id FROM entity_user WHERE user_id IN (
+				SELECT id FROM user WHERE id = ? OR email = ?))`, []interface{}{who, who}, nil
+		}
+
+		sql := "id IN (SELECT entity_id FROM entity_user)"
+		if isNo(value) {
+			sql = "NOT " + sql
+		}
+		return sql, nil, nil
+
+	case "in":
+		folder := "/" + strings.Trim(t.Value, "/")
+		if folder == "/" {
+			return "path LIKE ?", []interface{}{"/%"}, nil
+		}
+		return "path LIKE ?", []interface{}{likeEscape.Replace(folder) + "/%"}, nil
+	}
+
+	return "", nil, errors.New("unknown search key: " + t.Key)
+}
+
+const extensionSQL = "LOCATE('.', name) > 0 AND LOWER(SUBSTRING_INDEX(name, '.', -1)) IN (?)"
+
+// splitOperator separates comparison operator from the value, = is used by default
+func splitOperator(value string) (string, string) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(value, op) {
+			return op, value[len(op):]
+		}
+	}
+
+	return "=", value
+}
+
+func parseSize(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	end := strings.IndexFunc(value, func(r rune) bool { return !unicode.IsDigit(r) && r != '.' })
+	if end == -1 {
+		end = len(value)
+	}
+
+	unit, ok := sizeUnits[value[end:]]
+	if !ok {
+		return 0, errors.New("wrong size unit: " + value[end:])
+	}
+
+	size, err := strconv.ParseFloat(value[:end], 64)
+	if err != nil {
+		return 0, errors.New("wrong size: " + value)
+	}
+
+	return int64(size * float64(unit)), nil
+}
+
+func isNo(value string) bool {
+	value = strings.ToLower(value)
+	return value == "no" || value == "false" || value == "0"
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// files opened by the user, the last access of each file is shown first
+const recentSQL = `select ` + entityFields + ` from entity
+inner join access_log recent on recent.entity_id = entity.id and recent.user_id = ?
+where left(path, 1) != "." and (entity.tree = ? or exists (
+	select 1 from entity_user inner join entity shared on shared.id = entity_user.entity_id
+	where entity_user.user_id = ? and shared.tree = entity.tree
+	and (shared.path = entity.path or shared.path = "/" or LEFT(entity.path, char_length(shared.path) + 1) = concat(shared.path, "/"))))`
+
+// logAccess stores the time of opening the file by the user, only the last access of each file is kept
+func logAccess(user *CurrentUser, did int) {
+	if did == 0 {
+		return
+	}
+
+	now := time.Now()
+	_, err := conn.Exec("INSERT INTO access_log(user_id, entity_id, accessed) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE accessed = ?",
+		user.ID, did, now, now)
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
+
+type AccessTime struct {
+	Path     string
+	Tree     int
+	Accessed time.Time
+}
+
+// addAccessTime adds the time of the last access by the user
+func addAccessTime(files []RichFile, user *CurrentUser) {
+	if len(files) == 0 {
+		return
+	}
+
+	temp := make(map[string]*RichFile)
+	paths := make([]string, 0, len(files))
+	trees := []int{user.Root}
+	for i := range files {
+		tree, path := parseID(files[i].ID, user.Root)
+		paths = append(paths, path)
+		trees = append(trees, tree)
+		temp[files[i].ID] = &files[i]
+	}
+
+	times := make([]AccessTime, 0)
+	query, args, _ := sqlx.In(`
+SELECT entity.path, entity.tree, access_log.accessed
+FROM entity INNER JOIN access_log ON entity.id = access_log.entity_id
+WHERE access_log.user_id = ? AND entity.path IN (?) AND tree IN (?)`, user.ID, paths, trees)
+	err := conn.Select(&times, query, args...)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	for _, t := range times {
+		if f, ok := temp[clientID(t.Tree, t.Path, user.Root)]; ok {
+			f.Accessed = t.Accessed.Unix()
+		}
+	}
+}
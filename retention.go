@@ -0,0 +1,184 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// RetentionConfig describes which versions of files are kept
+// versions younger than KeepDays are kept, older ones are thinned to the last version of each day
+// till DailyDays and to the last version of each week till WeeklyDays, the rest is removed
+// the last KeepLast versions are always kept, pruning is disabled when nothing is configured
+type RetentionConfig struct {
+	KeepLast   int
+	KeepDays   int
+	DailyDays  int
+	WeeklyDays int
+	// minutes between runs of the pruner
+	Interval int `default:"60"`
+}
+
+func (c RetentionConfig) Enabled() bool {
+	return c.KeepLast > 0 || c.KeepDays > 0 || c.DailyDays > 0 || c.WeeklyDays > 0
+}
+
+type versionInfo struct {
+	ID       int
+	Content  string
+	Previous string
+	Modified time.Time
+}
+
+const day = 24 * time.Hour
+
+// startPruner removes outdated versions in the background
+func startPruner() {
+	if !Config.Retention.Enabled() {
+		return
+	}
+
+	interval := time.Duration(Config.Retention.Interval) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	go func() {
+		for {
+			pruneVersions(Config.Retention, time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// pruneVersions applies the retention policy to versions of all files
+func pruneVersions(policy RetentionConfig, now time.Time) {
+	ids := make([]int, 0)
+	err := conn.Select(&ids, "SELECT DISTINCT entity_id FROM entity_edit")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	count := 0
+	for _, id := range ids {
+		removed, err := pruneEntityVersions(id, policy, now)
+		if err != nil {
+			log.Println(err)
+		}
+		count += removed
+	}
+
+	if count > 0 {
+		log.Printf("Pruned %d versions", count)
+	}
+}
+
+func pruneEntityVersions(did int, policy RetentionConfig, now time.Time) (int, error) {
+	tx, err := conn.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// versions are locked, so they can't be pinned or commented while the entity is pruned
+	versions := make([]versionInfo, 0)
+	err = tx.Select(&versions, "SELECT id, content, previous, modified FROM entity_edit WHERE entity_id = ? AND event IN (?, ?) ORDER BY modified desc, id desc FOR UPDATE",
+		did, ContentEvent, RestoreVersionEvent)
+	if err != nil {
+		return 0, err
+	}
+
+	// only changes of content are pruned, other events are kept in the history
+	// named, pinned and commented versions are never removed
+	exempt := make(map[int]bool)
+	preserved := make([]int, 0)
+	tx.Select(&preserved, `SELECT id FROM entity_edit WHERE entity_id = ? AND (pinned = 1 OR label != '')
+		UNION SELECT DISTINCT edit_id FROM comment WHERE entity_id = ? AND edit_id != 0`, did, did)
+	for _, id := range preserved {
+		exempt[id] = true
+	}
+
+	keep := selectVersions(versions, exempt, policy, now)
+
+	removed := make([]int, 0)
+	blobs := make([]string, 0)
+	for i, v := range versions {
+		if !keep[i] {
+			removed = append(removed, v.ID)
+			blobs = append(blobs, v.Content)
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+
+	query, args, _ := sqlx.In("DELETE FROM entity_edit WHERE id IN (?)", removed)
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	// diff of a version is built against the previous kept version
+	previous := ""
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !keep[i] {
+			continue
+		}
+		if versions[i].Previous != previous {
+			_, err = tx.Exec("UPDATE entity_edit SET previous = ? WHERE id = ?", previous, versions[i].ID)
+			if err != nil {
+				return 0, err
+			}
+		}
+		previous = versions[i].Content
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	// blobs are released after the commit, so a rollback can't leave versions without content
+	for _, name := range blobs {
+		releaseBlob(name)
+	}
+	return len(removed), nil
+}
+
+// selectVersions marks versions (ordered from newest to oldest) which must be kept
+func selectVersions(versions []versionInfo, exempt map[int]bool, policy RetentionConfig, now time.Time) []bool {
+	keep := make([]bool, len(versions))
+	buckets := make(map[string]bool)
+
+	for i, v := range versions {
+		age := now.Sub(v.Modified)
+		var bucket string
+
+		switch {
+		case i == 0 || i < policy.KeepLast || exempt[v.ID]:
+			keep[i] = true
+			continue
+		case age < time.Duration(policy.KeepDays)*day:
+			keep[i] = true
+			continue
+		case age < time.Duration(policy.DailyDays)*day:
+			bucket = "d" + v.Modified.Format("2006-01-02")
+		case age < time.Duration(policy.WeeklyDays)*day:
+			year, week := v.Modified.ISOWeek()
+			bucket = "w" + strconv.Itoa(year) + "-" + strconv.Itoa(week)
+		default:
+			continue
+		}
+
+		// the first version of the bucket is the latest one
+		if !buckets[bucket] {
+			buckets[bucket] = true
+			keep[i] = true
+		}
+	}
+
+	return keep
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+)
+
+type SavedSearch struct {
+	ID     int    `json:"id"`
+	Name   string `json:"value"`
+	Query  string `json:"query"`
+	Folder string `json:"folder"`
+}
+
+func addSavedSearchRoutes(r chi.Router) {
+	r.Get("/searches", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+
+		searches := make([]SavedSearch, 0)
+		err := conn.Select(&searches, "SELECT id, name, query, folder FROM saved_search WHERE user_id = ? ORDER BY name", user.ID)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		format.JSON(w, 200, searches)
+	})
+
+	r.Post("/searches", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		r.ParseForm()
+		search := SavedSearch{Name: r.Form.Get("name"), Query: r.Form.Get("query"), Folder: r.Form.Get("id")}
+		if search.Folder == "" {
+			search.Folder = "/"
+		}
+		if search.Name == "" || search.Query == "" {
+			panic("both, 'name' and 'query' parameters must be provided")
+		}
+
+		// validate the query before saving
+		_, _, err := parseQuery(search.Query).Where(user)
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
+		}
+
+		res, err := conn.Exec("INSERT INTO saved_search(user_id, name, query, folder) VALUES(?, ?, ?, ?)", user.ID, search.Name, search.Query, search.Folder)
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
+		}
+
+		sid, _ := res.LastInsertId()
+		search.ID = int(sid)
+		format.JSON(w, 200, search)
+	})
+
+	r.Put("/searches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		r.ParseForm()
+		id := chi.URLParam(r, "id")
+
+		search := SavedSearch{}
+		err := conn.Get(&search, "SELECT id, name, query, folder FROM saved_search WHERE id = ? AND user_id = ?", id, user.ID)
+		if err != nil {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		if name := r.Form.Get("name"); name != "" {
+			search.Name = name
+		}
+		if query := r.Form.Get("query"); query != "" {
+			_, _, err = parseQuery(query).Where(user)
+			if err != nil {
+				format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+				return
+			}
+			search.Query = query
+		}
+
+		_, err = conn.Exec("UPDATE saved_search SET name = ?, query = ? WHERE id = ?", search.Name, search.Query, search.ID)
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
+		}
+
+		format.JSON(w, 200, search)
+	})
+
+	r.Delete("/searches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		id := chi.URLParam(r, "id")
+
+		conn.Exec("DELETE FROM saved_search WHERE id = ? AND user_id = ?", id, user.ID)
+		format.JSON(w, 200, Response{ID: id})
+	})
+}
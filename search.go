@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/xbsoftware/wfs"
+	db "github.com/xbsoftware/wfs-db"
+)
+
+// updateIndex stores text of the file in the full-text index
+func updateIndex(did int) error {
+	var data db.DBFile
+	err := conn.Get(&data, "SELECT id, name, type, size, content FROM entity WHERE id = ?", did)
+	if err != nil {
+		return err
+	}
+
+	text := ""
+	if data.Type == db.FileRecord && data.Content != "" && data.FileSize <= maxIndexSize {
+		file, err := os.Open(filepath.Join(Config.DataFolder, data.Content))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		text, err = extractText(data.FileName, file)
+		if err != nil {
+			log.Printf("can't extract text of %d: %s", did, err.Error())
+		}
+	}
+
+	if strings.TrimSpace(text) == "" {
+		_, err = conn.Exec("DELETE FROM entity_text WHERE entity_id = ?", did)
+		return err
+	}
+
+	_, err = conn.Exec("REPLACE INTO entity_text(entity_id, content) VALUES(?, ?)", did, text)
+	return err
+}
+
+// reindex rebuilds the full-text index for all files
+func reindex() {
+	ids := make([]int, 0)
+	err := conn.Select(&ids, "SELECT id FROM entity WHERE type = ?", db.FileRecord)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, id := range ids {
+		err = updateIndex(id)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	log.Printf("Indexed %d files", len(ids))
+}
+
+var fulltextOperators = strings.NewReplacer("+", " ", "-", " ", "<", " ", ">", " ", "(", " ", ")", " ", "~", " ", "*", " ", "\"", " ", "@", " ")
+
+// fulltextPhrase converts a search word to the phrase of boolean full-text search
+func fulltextPhrase(word string) string {
+	return "\"" + strings.TrimSpace(fulltextOperators.Replace(word)) + "\""
+}
+
+// searchFiles finds files by the search query inside of the folder
+func searchFiles(user *CurrentUser, id, search string, list *ListParams) ([]wfs.File, int, error) {
+	query := parseQuery(search)
+	if len(query.Terms) == 0 {
+		return nil, 0, nil
+	}
+
+	tree, folder := parseID(id, user.Root)
+	prefix := "/%"
+	if folder != "/" {
+		prefix = likeEscape.Replace(folder) + "/%"
+	}
+
+	where, params, err := query.Where(user)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return getPage(user.Root, list, `
+		SELECT `+entityFields+` FROM entity WHERE tree = ? AND path LIKE ? AND `+where, "type desc, name asc",
+		append([]interface{}{tree, prefix}, params...)...)
+}
+
+type TextMatch struct {
+	Path    string
+	Tree    int
+	Content string
+}
+
+// addSnippets adds the part of the document's text, which contains the search words
+func addSnippets(files []RichFile, user *CurrentUser, search string) {
+	names := parseQuery(search).Words()
+	if len(files) == 0 || len(names) == 0 {
+		return
+	}
+
+	words := make([]string, len(names))
+	for i := range names {
+		words[i] = regexp.QuoteMeta(names[i])
+	}
+	matcher := regexp.MustCompile("(?i)" + strings.Join(words, "|"))
+
+	temp := make(map[string]*RichFile)
+	paths := make([]string, 0, len(files))
+	trees := []int{user.Root}
+	for i := range files {
+		tree, path := parseID(files[i].ID, user.Root)
+		paths = append(paths, path)
+		trees = append(trees, tree)
+		temp[files[i].ID] = &files[i]
+	}
+
+	texts := make([]TextMatch, 0)
+	query, args, _ := sqlx.In(`
+SELECT entity.path, entity.tree, entity_text.content
+FROM entity INNER JOIN entity_text ON entity.id = entity_text.entity_id
+WHERE entity.path IN (?) AND tree IN (?)`, paths, trees)
+	err := conn.Select(&texts, query, args...)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	for _, t := range texts {
+		if f, ok := temp[clientID(t.Tree, t.Path, user.Root)]; ok {
+			f.Snippet = makeSnippet(t.Content, matcher)
+		}
+	}
+}
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// makeSnippet returns html with highlighted text around the first match
+func makeSnippet(text string, matcher *regexp.Regexp) string {
+	pos := matcher.FindStringIndex(text)
+	if pos == nil {
+		return ""
+	}
+
+	start := pos[0] - 60
+	if start < 0 {
+		start = 0
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	end := pos[1] + 120
+	if end > len(text) {
+		end = len(text)
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	part := spaces.ReplaceAllString(text[start:end], " ")
+
+	var buff bytes.Buffer
+	if start > 0 {
+		buff.WriteString("...")
+	}
+	last := 0
+	for _, m := range matcher.FindAllStringIndex(part, -1) {
+		buff.WriteString(html.EscapeString(part[last:m[0]]))
+		buff.WriteString("<span class='webix_docmanager_search_match'>")
+		buff.WriteString(html.EscapeString(part[m[0]:m[1]]))
+		buff.WriteString("</span>")
+		last = m[1]
+	}
+	buff.WriteString(html.EscapeString(part[last:]))
+	if end < len(text) {
+		buff.WriteString("...")
+	}
+
+	return buff.String()
+}
@@ -37,7 +37,7 @@ type FSFeatures struct {
 	Meta    map[string]bool `json:"meta"`
 }
 
-var drive wfs.Drive
+var driveConfig wfs.DriveConfig
 var conn *sqlx.DB
 var features = FSFeatures{
 	Preview: map[string]bool{},
@@ -52,8 +52,14 @@ type AppConfig struct {
 	UploadLimit  int64
 	Readonly     bool
 	ResetOnStart bool
-
-	DB DBConfig
+	Reindex      bool
+	DemoUser     int
+	TrashDays    int
+	// origins which can send requests with the session cookie
+	Origins []string
+
+	DB        DBConfig
+	Retention RetentionConfig
 }
 
 type DBConfig struct {
@@ -70,9 +76,12 @@ func main() {
 	flag.StringVar(&Config.DataFolder, "data", "", "location of data folder")
 	flag.StringVar(&Config.Preview, "preview", "", "url of preview generation service")
 	flag.BoolVar(&Config.ResetOnStart, "reset", false, "reset data in DB")
+	flag.BoolVar(&Config.Reindex, "reindex", false, "rebuild full-text index of documents")
 	flag.BoolVar(&Config.Readonly, "readonly", false, "readonly mode")
 	flag.Int64Var(&Config.UploadLimit, "limit", 10_000_000, "max file size to upload")
 	flag.StringVar(&Config.Port, "port", ":3200", "port for web server")
+	flag.IntVar(&Config.DemoUser, "user", 0, "demo user for requests without credentials, enables demo login")
+	flag.IntVar(&Config.TrashDays, "trash-days", 0, "days before removal of items from the trash, 0 to keep them forever")
 	flag.Parse()
 
 	configor.New(&configor.Config{ENVPrefix: "APP", Silent: true}).Load(&Config, "config.yml")
@@ -90,7 +99,7 @@ func main() {
 
 	// common drive access
 	var err error
-	driveConfig := wfs.DriveConfig{Verbose: false}
+	driveConfig = wfs.DriveConfig{Verbose: false}
 	driveConfig.Operation = &wfs.OperationConfig{PreventNameCollision: true}
 	if Config.Readonly {
 		temp := wfs.Policy(&wfs.ReadOnlyPolicy{})
@@ -105,33 +114,47 @@ func main() {
 	}
 
 	migration(conn)
+	migrateBlobs()
 
 	os.Mkdir(Config.DataFolder, 0777)
-	drive, err = db.NewDBDrive(conn, Config.DataFolder, "entity", User.Root, &driveConfig)
-	if err != nil {
-		log.Fatal(err)
-	}
 
 	if Config.ResetOnStart {
-		demodata.ResetDemoData(drive, conn)
+		demodata.ResetDemoData(getDrive(&CurrentUser{ID: 1, Root: defaultRoot}), conn, Config.DataFolder)
 	}
+	if Config.ResetOnStart || Config.Reindex {
+		reindex()
+	}
+	startPruner()
+	startJanitor()
 
-	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
+	root := chi.NewRouter()
+	root.Use(middleware.Logger)
+	root.Use(middleware.Recoverer)
 
+	// cookies are accepted only from the configured origins
+	origins := Config.Origins
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
 	cors := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
+		AllowedOrigins:   origins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		AllowCredentials: true,
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Link-Password"},
+		AllowCredentials: len(Config.Origins) > 0,
 		MaxAge:           300,
 	})
-	r.Use(cors.Handler)
+	root.Use(cors.Handler)
 
+	addAuthRoutes(root)
+	addPublicLinkRoutes(root)
+
+	r := root.With(authMiddleware)
 	addExtrasRoutes(r)
 	addFilesRoutes(r)
 	addTrashRoutes(r)
+	addLinkRoutes(r)
+	addSavedSearchRoutes(r)
+	addCommentRoutes(r)
 
 	r.Get("/icons/{size}/{type}/{name}", func(w http.ResponseWriter, r *http.Request) {
 		size := chi.URLParam(r, "size")
@@ -153,19 +176,38 @@ func main() {
 	r.Get("/preview", getFilePreview)
 
 	r.Get("/search", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 		id := r.URL.Query().Get("id")
+		if id == "" {
+			id = "/"
+		}
 		search := r.URL.Query().Get("search")
 
-		data, err := drive.Search(id, search)
+		if !hasAccess(user, dbID(id, user), ViewerAccess) {
+			format.Text(w, 500, "Access Denied")
+			return
+		}
+
+		list, err := getListParams(r)
+		if err != nil {
+			format.Text(w, 500, err.Error())
+			return
+		}
+
+		data, _, err := searchFiles(user, id, search, list)
 
 		if err != nil {
 			format.Text(w, 500, err.Error())
 			return
 		}
-		format.JSON(w, 200, data)
+
+		files := enrich(data, user, conn)
+		addSnippets(files, user, search)
+		format.JSON(w, 200, files)
 	})
 
 	r.Get("/folders", func(w http.ResponseWriter, r *http.Request) {
+		drive := getUser(r).Drive
 		id := r.URL.Query().Get("id")
 		if id == "" {
 			id = "/"
@@ -187,18 +229,23 @@ func main() {
 	})
 
 	r.Post("/copy", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		drive := user.Drive
 		r.ParseForm()
-		id := r.Form.Get("id")
+		source := r.Form.Get("id")
 		to := r.Form.Get("to")
-		if id == "" || to == "" {
+		if source == "" || to == "" {
 			panic("both, 'id' and 'to' parameters must be provided")
 		}
 
-		id, err := drive.Copy(id, to, "")
+		id, err := drive.Copy(source, to, "")
 		if err != nil {
 			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
 			return
 		}
+		_, oldPath := parseID(source, user.Root)
+		_, newPath := parseID(id, user.Root)
+		saveEvent(conn, dbID(id, user), user, CopyEvent, oldPath, newPath)
 
 		info, err := drive.Info(id)
 		if err != nil {
@@ -210,18 +257,24 @@ func main() {
 	})
 
 	r.Post("/move", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		drive := user.Drive
 		r.ParseForm()
-		id := r.Form.Get("id")
+		source := r.Form.Get("id")
 		to := r.Form.Get("to")
-		if id == "" || to == "" {
+		if source == "" || to == "" {
 			panic("both, 'id' and 'to' parameters must be provided")
 		}
 
-		id, err := drive.Move(id, to, "")
+		did := dbID(source, user)
+		id, err := drive.Move(source, to, "")
 		if err != nil {
 			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
 			return
 		}
+		_, oldPath := parseID(source, user.Root)
+		_, newPath := parseID(id, user.Root)
+		saveEvent(conn, did, user, MoveEvent, oldPath, newPath)
 
 		info, err := drive.Info(id)
 		if err != nil {
@@ -233,18 +286,24 @@ func main() {
 	})
 
 	r.Post("/rename", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		drive := user.Drive
 		r.ParseForm()
-		id := r.Form.Get("id")
+		source := r.Form.Get("id")
 		name := r.Form.Get("name")
-		if id == "" || name == "" {
+		if source == "" || name == "" {
 			panic("both, 'id' and 'name' parameters must be provided")
 		}
 
-		id, err := drive.Move(id, "", name)
+		did := dbID(source, user)
+		id, err := drive.Move(source, "", name)
 		if err != nil {
 			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
 			return
 		}
+		_, oldPath := parseID(source, user.Root)
+		_, newPath := parseID(id, user.Root)
+		saveEvent(conn, did, user, RenameEvent, oldPath, newPath)
 
 		format.JSON(w, 200, Response{ID: id})
 	})
@@ -254,6 +313,7 @@ func main() {
 	})
 
 	r.Post("/makefile", func(w http.ResponseWriter, r *http.Request) {
+		drive := getUser(r).Drive
 		r.ParseForm()
 		id := r.Form.Get("id")
 		name := r.Form.Get("name")
@@ -277,6 +337,7 @@ func main() {
 	})
 
 	r.Post("/makedir", func(w http.ResponseWriter, r *http.Request) {
+		drive := getUser(r).Drive
 		r.ParseForm()
 		id := r.Form.Get("id")
 		name := r.Form.Get("name")
@@ -300,6 +361,8 @@ func main() {
 	})
 
 	r.Get("/text", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		drive := user.Drive
 		id := r.URL.Query().Get("id")
 		if id == "" {
 			panic("id not provided")
@@ -309,12 +372,15 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		logAccess(user, dbID(id, user))
 
 		w.Header().Add("Content-type", "text/plain")
 		io.Copy(w, data)
 	})
 
 	r.Post("/text", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		drive := user.Drive
 		r.ParseForm()
 
 		id := r.Form.Get("id")
@@ -327,8 +393,9 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		updateIndex(dbID(id, user))
 
-		info, _ := saveVersion(id, nil)
+		info, _ := saveVersion(id, user, nil)
 
 		format.JSON(w, 200, info)
 	})
@@ -339,26 +406,10 @@ func main() {
 			panic("id not provided")
 		}
 
-		info, err := drive.Info(id)
-		if err != nil {
-			format.Text(w, 500, "Access denied")
-			return
-		}
-
-		data, err := drive.Read(id)
-		if err != nil {
-			format.Text(w, 500, "Access denied")
-			return
-		}
-
-		disposition := "inline"
-		_, ok := r.URL.Query()["download"]
-		if ok {
-			disposition = "attachment"
+		user := getUser(r)
+		if serveDirect(w, r, user.Drive, id) {
+			logAccess(user, dbID(id, user))
 		}
-
-		w.Header().Set("Content-Disposition", disposition+"; filename=\""+info.Name+"\"")
-		http.ServeContent(w, r, "", time.Now(), data)
 	})
 
 	r.Post("/direct", func(w http.ResponseWriter, r *http.Request) {
@@ -369,13 +420,44 @@ func main() {
 	r.Get("/meta", getMetaInfo)
 
 	log.Printf("Starting webserver at port " + Config.Port)
-	err = http.ListenAndServe(Config.Port, r)
+	err = http.ListenAndServe(Config.Port, root)
 	if err != nil {
 		log.Println(err.Error())
 	}
 }
 
+// serveDirect sends content of the file, returns false if the file can't be read
+func serveDirect(w http.ResponseWriter, r *http.Request, drive wfs.Drive, id string) bool {
+	info, err := drive.Info(id)
+	if err != nil {
+		format.Text(w, 500, "Access denied")
+		return false
+	}
+
+	data, err := drive.Read(id)
+	if err != nil {
+		format.Text(w, 500, "Access denied")
+		return false
+	}
+	if x, ok := data.(io.Closer); ok {
+		defer x.Close()
+	}
+
+	disposition := "inline"
+	_, ok := r.URL.Query()["download"]
+	if ok {
+		disposition = "attachment"
+	}
+
+	w.Header().Set("Content-Disposition", disposition+"; filename=\""+info.Name+"\"")
+	http.ServeContent(w, r, "", time.Now(), data)
+	return true
+}
+
 func handleUpload(w http.ResponseWriter, r *http.Request, makeNew bool) {
+	user := getUser(r)
+	drive := user.Drive
+
 	// buffer for file parsing, this is NOT the max upload size
 	var limit = int64(32 << 20) // default is 32MB
 	if Config.UploadLimit < limit {
@@ -406,27 +488,74 @@ func handleUpload(w http.ResponseWriter, r *http.Request, makeNew bool) {
 		format.Text(w, 500, "Access Denied")
 		return
 	}
+	updateIndex(dbID(fileID, user))
 
-	info, err := saveVersion(fileID, nil)
+	info, err := saveVersion(fileID, user, nil)
 	format.JSON(w, 200, info)
 }
 
-func saveVersion(id string, restore *time.Time) (*wfs.File, error) {
+// types of events in the history of the file
+const (
+	ContentEvent        = "content"
+	RenameEvent         = "rename"
+	MoveEvent           = "move"
+	CopyEvent           = "copy"
+	TrashEvent          = "trash"
+	RestoreEvent        = "restore"
+	RestoreVersionEvent = "restore-version"
+)
+
+// saveEvent adds the event to the history of the file, in the transaction of the operation if there is one
+// events don't store content, so they don't keep blobs which are removed by the retention policy
+func saveEvent(q sqlx.Execer, did int, user *CurrentUser, event, oldPath, newPath string) error {
+	if did == 0 {
+		return nil
+	}
+
+	_, err := q.Exec(`INSERT INTO entity_edit(entity_id, modified, user_id, event, old_path, new_path)
+		VALUES(?, ?, ?, ?, ?, ?)`, did, time.Now(), user.ID, event, oldPath, newPath)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func saveVersion(id string, user *CurrentUser, restore *time.Time) (*wfs.File, error) {
 	var data db.DBFile
 
-	err := conn.Get(&data, "select entity.* from entity where path = ?", id)
+	tx, err := conn.Beginx()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
 
-	out := &wfs.File{ID: data.Path, Name: data.FileName, Date: data.LastModTime.Unix(), Size: data.FileSize, Type: wfs.GetType(data.FileName, data.IsDir())}
+	// the row is locked, so the content can't be replaced before its blob is referenced by the version
+	tree, path := parseID(id, user.Root)
+	err = tx.Get(&data, "select "+fileFields+" from entity where path = ? and tree = ? for update", path, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &wfs.File{ID: id, Name: data.FileName, Date: data.LastModTime.Unix(), Size: data.FileSize, Type: wfs.GetType(data.FileName, data.IsDir())}
 
 	// get previous version
 	var older db.DBFile
-	err = conn.Get(&older, "select content from entity_edit where entity_id = ? order by modified desc limit 1;", data.ID)
+	err = tx.Get(&older, "select content from entity_edit where entity_id = ? and content != '' order by modified desc, id desc limit 1;", data.ID)
+
+	event := ContentEvent
+	if restore != nil {
+		event = RestoreVersionEvent
+	}
 
 	// write new edit version
-	_, err = conn.Exec("INSERT INTO entity_edit(entity_id, content, modified, user_id, previous, origin) VALUES(?, ?, ?, ?, ?, ?)", data.ID, data.Content, data.LastModTime, User.Root, older.Content, restore)
+	_, err = tx.Exec("INSERT INTO entity_edit(entity_id, content, modified, user_id, previous, origin, event, new_path) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		data.ID, data.Content, data.LastModTime, user.ID, older.Content, restore, event, data.Path)
+	if err == nil {
+		err = addBlobRef(tx, data.Content)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 
 	if err != nil {
 		log.Println(err)
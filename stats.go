@@ -8,6 +8,9 @@ type FSStats struct {
 	Free  uint64 `json:"free"`
 	Total uint64 `json:"total"`
 	Used  uint64 `json:"used"`
+	// size of files and versions, and size of stored unique content
+	Logical  uint64 `json:"logical"`
+	Physical uint64 `json:"physical"`
 }
 
 type FSInfo struct {
@@ -16,7 +19,14 @@ type FSInfo struct {
 }
 
 func getInfo(w http.ResponseWriter, r *http.Request) {
-	used, free, err := drive.Stats()
+	user := getUser(r)
+	used, free, err := user.Drive.Stats()
+	if err != nil {
+		format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+		return
+	}
+
+	logical, physical, err := getUsage(user.Root)
 	if err != nil {
 		format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
 		return
@@ -25,7 +35,7 @@ func getInfo(w http.ResponseWriter, r *http.Request) {
 	total := free + used
 
 	format.JSON(w, 200, FSInfo{
-		Stats:    FSStats{Free: free, Used: used, Total: total},
+		Stats:    FSStats{Free: free, Used: used, Total: total, Logical: logical, Physical: physical},
 		Features: features,
 	})
 }
@@ -1,174 +1,611 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+	"log"
+	"math"
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jmoiron/sqlx"
+	"github.com/xbsoftware/wfs"
 	db "github.com/xbsoftware/wfs-db"
 )
 
 func addTrashRoutes(r chi.Router) {
 	r.Post("/delete", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		drive := user.Drive
 		r.ParseForm()
 		id := r.Form.Get("id")
-		if id == "" || id[0:2] == "./" {
-			panic("path not provided")
+		if id == "" || id == "/" || strings.HasPrefix(id, "./") {
+			format.JSON(w, 500, Response{Invalid: true, Error: "wrong id provided"})
+			return
 		}
-
-		obj, err := drive.Info(id)
-		if err != nil {
-			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+		if id[0] == '~' {
+			format.JSON(w, 500, Response{Invalid: true, Error: "Access Denied"})
 			return
 		}
 
-		did := dbID(id)
-		_, err = conn.Exec("update entity set path = ?, folder = -1 where path = ? AND tree = ?", "./"+strconv.Itoa(did)+id, id, User.Root)
+		_, err := drive.Info(id)
 		if err != nil {
 			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
 			return
 		}
 
-		// mark all files in deleted folder
-		if obj.Type == "folder" {
-			_, err = conn.Exec("update entity set path = concat(\".\", path) where path LIKE ? AND tree = ?", id+"/%", User.Root)
+		err = withTrashTx(func(tx *sqlx.Tx, after *postCommit) error {
+			obj := db.DBFile{}
+			err := tx.Get(&obj, "SELECT "+fileFields+" FROM entity WHERE path = ? AND tree = ? FOR UPDATE", id, user.Root)
 			if err != nil {
-				format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
-				return
+				return errors.New("wrong id provided")
 			}
+			return trashEntity(tx, user, &obj)
+		})
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
 		}
 
 		format.JSON(w, 200, Response{})
 	})
 
 	r.Put("/delete", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+		drive := user.Drive
 		r.ParseForm()
-		id := r.Form.Get("id")
-		if id[0:2] != "./" {
-			panic("wrong id provided")
+		target := r.Form.Get("target")
+		conflict := r.Form.Get("conflict")
+		if conflict == "" {
+			conflict = RenameConflict
+		}
+		if !conflictModes[conflict] {
+			format.JSON(w, 500, Response{Invalid: true, Error: "unknown conflict mode"})
+			return
 		}
 
-		obj := db.DBFile{}
-		conn.Get(&obj, "select * from entity where path=? and tree=?", id, User.Root)
-		if obj.ID == 0 {
-			panic("wrong id provided")
+		ids, bulk := r.Form["ids"]
+		if !bulk {
+			ids = []string{r.Form.Get("id")}
 		}
 
-		// all involved files
-		ids := make([]int, 0)
-		if obj.Type == 2 {
-			ids = append(ids, selectIdRec(obj.ID)...)
+		results, err := processTrash(ids, func(tx *sqlx.Tx, id string, after *postCommit) (string, error) {
+			obj, err := getTrashItem(tx, id, user.Root)
+			if err != nil {
+				return "", err
+			}
+			return restoreEntity(tx, user, obj, target, conflict, after)
+		})
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
 		}
 
-		prefixLen := len("./" + strconv.Itoa(obj.ID))
-		deletedPath := obj.Path[prefixLen:]
-		restorePath := r.Form.Get("target")
-		if restorePath == "" {
-			restorePath = path.Dir(deletedPath)
+		for i := range results {
+			if results[i].Error == "" {
+				info, _ := drive.Info(results[i].Path)
+				results[i].File = &info
+			}
 		}
-		// check restore folder
-		newRoot := 0
-		conn.Get(&newRoot, "SELECT id FROM entity WHERE path = ? AND tree = ?", restorePath, User.Root)
-		if newRoot == 0 {
-			conn.Get(&newRoot, "SELECT id FROM entity WHERE path = \"/\" AND tree = ?", User.Root)
+
+		if bulk {
+			format.JSON(w, 200, results)
+		} else if results[0].Error != "" {
+			format.JSON(w, 500, Response{Invalid: true, Error: results[0].Error})
+		} else {
+			format.JSON(w, 200, results[0].File)
 		}
+	})
 
-		targetName := obj.FileName
-		targetPath := path.Join(restorePath, path.Base(deletedPath))
+	r.Delete("/delete", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
 
-		// ensure that file name is not occupied
-		for {
-			fileUsed := 0
-			conn.Get(&fileUsed, "SELECT id FROM entity WHERE path = ? AND tree = ?", targetPath, User.Root)
-			if fileUsed == 0 {
-				break
+		ids, bulk := r.URL.Query()["ids"]
+		if !bulk {
+			ids = []string{r.URL.Query().Get("id")}
+		}
+
+		results, err := processTrash(ids, func(tx *sqlx.Tx, id string, after *postCommit) (string, error) {
+			obj, err := getTrashItem(tx, id, user.Root)
+			if err != nil {
+				return "", err
 			}
+			return "", purgeEntity(tx, obj, after)
+		})
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
+		}
 
-			ext := path.Ext(targetName)
-			targetName = makeUnique(targetName, ext, obj.Type)
-			targetPath = makeUnique(targetPath, ext, obj.Type)
+		if bulk {
+			format.JSON(w, 200, results)
+		} else if results[0].Error != "" {
+			format.JSON(w, 500, Response{Invalid: true, Error: results[0].Error})
+		} else {
+			format.JSON(w, 200, Response{})
 		}
+	})
 
-		// restore the object
-		_, err := conn.Exec("UPDATE entity set name = ?, path = ?, folder = ? where path = ? AND tree = ?", targetName, targetPath, newRoot, id, User.Root)
+	r.Post("/trash/empty", func(w http.ResponseWriter, r *http.Request) {
+		user := getUser(r)
+
+		ids := make([]string, 0)
+		err := conn.Select(&ids, "SELECT path FROM entity WHERE folder = -1 AND tree = ?", user.Root)
 		if err != nil {
 			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
 			return
 		}
 
-		// and all inner objects
-		if len(ids) > 0 {
-			sql, args, _ := sqlx.In("UPDATE entity set path = REPLACE(path, ?, ?) where id IN (?) AND tree = ?", "."+deletedPath+"/", targetPath+"/", ids, User.Root)
-			_, err = conn.Exec(sql, args...)
+		results, err := processTrash(ids, func(tx *sqlx.Tx, id string, after *postCommit) (string, error) {
+			obj, err := getTrashItem(tx, id, user.Root)
 			if err != nil {
-				format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
-				return
+				return "", err
 			}
+			return "", purgeEntity(tx, obj, after)
+		})
+		if err != nil {
+			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
+			return
 		}
 
-		info, err := drive.Info(targetPath)
-		format.JSON(w, 200, info)
+		format.JSON(w, 200, results)
 	})
+}
 
-	r.Delete("/delete", func(w http.ResponseWriter, r *http.Request) {
-		id := r.URL.Query().Get("id")
-		if id[0:2] != "./" {
-			panic("wrong id provided")
+// TrashResult is the result of the operation with one item of the trash
+type TrashResult struct {
+	ID    string    `json:"id"`
+	Error string    `json:"error,omitempty"`
+	File  *wfs.File `json:"file,omitempty"`
+	Path  string    `json:"-"`
+}
+
+// postCommit contains actions which must be done only after the commit of the transaction
+// like removal of content files from the disk
+type postCommit []func()
+
+func (p *postCommit) add(f func()) {
+	*p = append(*p, f)
+}
+
+func (p postCommit) run() {
+	for _, f := range p {
+		f()
+	}
+}
+
+// withTrashTx runs the operation in the transaction
+func withTrashTx(f func(tx *sqlx.Tx, after *postCommit) error) error {
+	tx, err := conn.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	after := postCommit{}
+	err = f(tx, &after)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	after.run()
+	return nil
+}
+
+// processTrash runs the operation for each item in the same transaction
+// failed items are rolled back separately and reported in results
+func processTrash(ids []string, f func(tx *sqlx.Tx, id string, after *postCommit) (string, error)) ([]TrashResult, error) {
+	results := make([]TrashResult, len(ids))
+
+	err := withTrashTx(func(tx *sqlx.Tx, after *postCommit) error {
+		for i, id := range ids {
+			results[i].ID = id
+
+			_, err := tx.Exec("SAVEPOINT trash_item")
+			if err != nil {
+				return err
+			}
+
+			step := postCommit{}
+			results[i].Path, err = f(tx, id, &step)
+			if err != nil {
+				results[i].Error = err.Error()
+				_, err = tx.Exec("ROLLBACK TO SAVEPOINT trash_item")
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			*after = append(*after, step...)
 		}
-		obj := db.DBFile{}
 
-		conn.Get(&obj, "select * from entity where path=? and tree=?", id, User.Root)
-		if obj.ID == 0 {
-			panic("wrong id provided")
+		return nil
+	})
+
+	return results, err
+}
+
+// getTrashItem returns the root item of the trash
+func getTrashItem(tx *sqlx.Tx, id string, tree int) (*db.DBFile, error) {
+	if !strings.HasPrefix(id, "./") {
+		return nil, errors.New("wrong id provided")
+	}
+
+	obj := db.DBFile{}
+	err := tx.Get(&obj, "SELECT "+fileFields+" FROM entity WHERE path = ? AND tree = ? AND folder = -1 FOR UPDATE", id, tree)
+	if err != nil {
+		return nil, errors.New("wrong id provided")
+	}
+
+	return &obj, nil
+}
+
+// strategies of restoring an item to the occupied path
+const (
+	RenameConflict    = "rename"
+	OverwriteConflict = "overwrite"
+	MergeConflict     = "merge"
+	FailConflict      = "fail"
+)
+
+var conflictModes = map[string]bool{
+	RenameConflict:    true,
+	OverwriteConflict: true,
+	MergeConflict:     true,
+	FailConflict:      true,
+}
+
+// restoreEntity moves the item from the trash to its original folder or to the target folder
+func restoreEntity(tx *sqlx.Tx, user *CurrentUser, obj *db.DBFile, target, conflict string, after *postCommit) (string, error) {
+	deletedPath := deletedPath(obj.Path, obj)
+	restorePath := target
+	if restorePath == "" {
+		restorePath = path.Dir(deletedPath)
+	}
+	// check restore folder
+	newRoot := 0
+	err := tx.Get(&newRoot, "SELECT id FROM entity WHERE path = ? AND tree = ? AND type = ?", restorePath, user.Root, db.FolderRecord)
+	if err == sql.ErrNoRows {
+		restorePath = "/"
+		err = tx.Get(&newRoot, "SELECT id FROM entity WHERE path = \"/\" AND tree = ?", user.Root)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// inner objects of the trashed folder keep their original paths with the "." prefix
+	targetPath, err := placeEntity(tx, user, obj, "."+deletedPath, newRoot, path.Join(restorePath, obj.FileName), conflict, after)
+	if err != nil {
+		return "", err
+	}
+
+	// the restored folder can be merged into the existing one
+	did := 0
+	err = tx.Get(&did, "SELECT id FROM entity WHERE path = ? AND tree = ?", targetPath, user.Root)
+	if err != nil {
+		return "", err
+	}
+	err = saveEvent(tx, did, user, RestoreEvent, deletedPath, targetPath)
+	if err != nil {
+		return "", err
+	}
+	return targetPath, nil
+}
+
+// placeEntity moves the trashed object and all its inner objects to the target path
+// prefix is the current path of the inner objects of the folder
+func placeEntity(tx *sqlx.Tx, user *CurrentUser, obj *db.DBFile, prefix string, folder int, targetPath, conflict string, after *postCommit) (string, error) {
+	// lock of the target folder serializes restores into it, so the free name can't be taken meanwhile
+	err := lockEntity(tx, folder)
+	if err != nil {
+		return "", err
+	}
+
+	existing := db.DBFile{}
+	err = tx.Get(&existing, "SELECT "+fileFields+" FROM entity WHERE path = ? AND tree = ? FOR UPDATE", targetPath, user.Root)
+	if err == nil {
+		switch {
+		case conflict == FailConflict:
+			return "", errors.New("the target path is already used")
+		case conflict == OverwriteConflict:
+			err = trashEntity(tx, user, &existing)
+			if err != nil {
+				return "", err
+			}
+		case conflict == MergeConflict && obj.Type == db.FolderRecord && existing.Type == db.FolderRecord:
+			return targetPath, mergeEntity(tx, user, obj, &existing, after)
+		default:
+			targetPath, err = uniquePath(tx, targetPath, obj.Type, user.Root)
+			if err != nil {
+				return "", err
+			}
 		}
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
 
-		// all involved files
-		ids := []int{obj.ID}
-		if obj.Type == 2 {
-			ids = append(ids, selectIdRec(obj.ID)...)
+	// all involved files
+	ids := make([]int, 0)
+	if obj.Type == db.FolderRecord {
+		ids, err = selectIdRec(tx, obj.ID, user.Root)
+		if err != nil {
+			return "", err
 		}
+	}
 
-		// delete related markers
-		idStr, args, _ := sqlx.In("entity_id IN(?) AND user_id = ? ", ids, User.Root)
-		conn.Exec("DELETE FROM favorite WHERE "+idStr, args...)
-		idStr, args, _ = sqlx.In("entity_id IN(?)", ids)
-		conn.Exec("DELETE FROM entity_tag WHERE "+idStr, args...)
-		conn.Exec("DELETE FROM entity_user WHERE "+idStr, args...)
+	// restore the object
+	_, err = tx.Exec("UPDATE entity set name = ?, path = ?, folder = ?, deleted = NULL where id = ?", path.Base(targetPath), targetPath, folder, obj.ID)
+	if err != nil {
+		return "", err
+	}
 
-		// delete file itself
-		idStr, args, _ = sqlx.In("DELETE FROM entity where id in (?)", ids)
-		_, err := conn.Exec(idStr, args...)
+	// and all inner objects
+	if len(ids) > 0 {
+		query, args, _ := sqlx.In("UPDATE entity set path = REPLACE(path, ?, ?) where id IN (?) AND tree = ?", prefix+"/", targetPath+"/", ids, user.Root)
+		_, err = tx.Exec(query, args...)
 		if err != nil {
-			format.JSON(w, 500, Response{Invalid: true, Error: err.Error()})
-			return
+			return "", err
 		}
+	}
 
-		format.JSON(w, 200, Response{})
+	return targetPath, nil
+}
+
+// mergeEntity restores inner objects of the trashed folder into the existing folder
+// nested folders are merged as well, files with used names are renamed
+func mergeEntity(tx *sqlx.Tx, user *CurrentUser, obj, into *db.DBFile, after *postCommit) error {
+	children := make([]db.DBFile, 0)
+	err := tx.Select(&children, "SELECT "+fileFields+" FROM entity WHERE folder = ? AND tree = ?", obj.ID, user.Root)
+	if err != nil {
+		return err
+	}
+
+	for i := range children {
+		c := &children[i]
+		_, err = placeEntity(tx, user, c, c.Path, into.ID, path.Join(into.Path, c.FileName), MergeConflict, after)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the folder is empty now
+	return purgeEntity(tx, obj, after)
+}
+
+// trashEntity moves the object and all its inner objects to the trash
+func trashEntity(tx *sqlx.Tx, user *CurrentUser, obj *db.DBFile) error {
+	// all involved files
+	ids := make([]int, 0)
+	var err error
+	if obj.Type == db.FolderRecord {
+		ids, err = selectIdRec(tx, obj.ID, obj.Tree)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE entity SET path = ?, folder = -1, deleted = ? WHERE id = ?", "./"+strconv.Itoa(obj.ID)+obj.Path, time.Now(), obj.ID)
+	if err != nil {
+		return err
+	}
+
+	// mark all files in deleted folder
+	if len(ids) > 0 {
+		query, args, _ := sqlx.In("UPDATE entity SET path = concat(\".\", path) WHERE id IN (?)", ids)
+		_, err = tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return saveEvent(tx, obj.ID, user, TrashEvent, obj.Path, "")
+}
+
+// purgeEntity permanently deletes the item of the trash with all its data
+func purgeEntity(tx *sqlx.Tx, obj *db.DBFile, after *postCommit) error {
+	// all involved files
+	ids := []int{obj.ID}
+	if obj.Type == db.FolderRecord {
+		inner, err := selectIdRec(tx, obj.ID, obj.Tree)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, inner...)
+	}
+
+	// content of files and all their versions
+	blobs := make([]string, 0)
+	idStr, args, _ := sqlx.In(`SELECT content FROM entity WHERE id IN (?) AND content != ''
+		UNION ALL SELECT content FROM entity_edit WHERE entity_id IN (?) AND content != ''`, ids, ids)
+	err := tx.Select(&blobs, idStr, args...)
+	if err != nil {
+		return err
+	}
+
+	// delete related data
+	idStr, args, _ = sqlx.In("entity_id IN(?)", ids)
+	for _, sql := range []string{
+		"DELETE FROM favorite WHERE " + idStr,
+		"DELETE FROM entity_tag WHERE " + idStr,
+		"DELETE FROM entity_user WHERE " + idStr,
+		"DELETE FROM entity_text WHERE " + idStr,
+		"DELETE FROM access_log WHERE " + idStr,
+		"DELETE FROM comment_mention WHERE " + idStr,
+		"DELETE FROM share_link WHERE " + idStr,
+		"DELETE FROM comment_revision WHERE comment_id IN (SELECT id FROM comment WHERE " + idStr + ")",
+		"DELETE FROM comment WHERE " + idStr,
+		"DELETE FROM entity_edit WHERE " + idStr,
+	} {
+		_, err = tx.Exec(sql, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// delete file itself
+	idStr, args, _ = sqlx.In("DELETE FROM entity where id in (?)", ids)
+	_, err = tx.Exec(idStr, args...)
+	if err != nil {
+		return err
+	}
+
+	// previews are removed together with unused blobs
+	after.add(func() {
+		for _, name := range blobs {
+			releaseBlob(name)
+		}
 	})
+
+	return nil
 }
 
-func selectIdRec(folder int) []int {
-	var ids = make([]db.DBFile, 0)
-	conn.Select(&ids, "select id,type FROM entity where folder = ? AND tree = ?", folder, User.Root)
+// deletedPath returns the path of the trashed file before its deletion
+func deletedPath(p string, obj *db.DBFile) string {
+	prefix := "./" + strconv.Itoa(obj.ID)
+	if p == obj.Path && strings.HasPrefix(p, prefix) {
+		return p[len(prefix):]
+	}
+
+	return strings.TrimPrefix(p, ".")
+}
+
+// startJanitor purges items which are in the trash longer than the configured number of days
+func startJanitor() {
+	if Config.TrashDays <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			purgeTrash(time.Now().Add(-time.Duration(Config.TrashDays) * day))
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func purgeTrash(before time.Time) {
+	items := make([]db.DBFile, 0)
+	err := conn.Select(&items, "SELECT "+fileFields+" FROM entity WHERE folder = -1 AND deleted < ?", before)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-	out := make([]int, 0, len(ids))
-	for i := range ids {
-		out = append(out, ids[i].ID)
-		if ids[i].Type == 2 {
-			out = append(out, selectIdRec(ids[i].ID)...)
+	for i := range items {
+		err = withTrashTx(func(tx *sqlx.Tx, after *postCommit) error {
+			// the item could be restored meanwhile
+			obj, err := getTrashItem(tx, items[i].Path, items[i].Tree)
+			if err != nil {
+				return err
+			}
+			return purgeEntity(tx, obj, after)
+		})
+		if err != nil {
+			log.Println(err)
 		}
 	}
 
-	return out
+	if len(items) > 0 {
+		log.Printf("Purged %d items from the trash", len(items))
+	}
+}
+
+type TrashTime struct {
+	Path    string
+	Deleted time.Time
 }
 
-func makeUnique(name, ext string, ftype int) string {
-	if ftype == 2 || ext == "" {
-		return name + ".restored"
+// addPurgeDays adds the number of days till the item will be removed from the trash
+func addPurgeDays(files []RichFile, user *CurrentUser) {
+	if len(files) == 0 || Config.TrashDays <= 0 {
+		return
 	}
 
-	index := len(name) - len(ext)
-	return name[:index] + ".restored" + name[index:]
+	temp := make(map[string]*RichFile)
+	paths := make([]string, 0, len(files))
+	for i := range files {
+		paths = append(paths, files[i].ID)
+		temp[files[i].ID] = &files[i]
+	}
+
+	times := make([]TrashTime, 0)
+	query, args, _ := sqlx.In("SELECT path, deleted FROM entity WHERE path IN (?) AND tree = ? AND deleted IS NOT NULL", paths, user.Root)
+	err := conn.Select(&times, query, args...)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, t := range times {
+		days := int(math.Ceil(t.Deleted.Add(time.Duration(Config.TrashDays)*day).Sub(now).Hours() / 24))
+		if days < 0 {
+			days = 0
+		}
+		if f, ok := temp[t.Path]; ok {
+			f.Purge = &days
+		}
+	}
+}
+
+// selectIdRec returns ids of all files and folders inside of the folder
+// and locks them till the end of the transaction
+// locking reads see the latest state, so items which were trashed meanwhile are skipped with their content
+func selectIdRec(tx *sqlx.Tx, folder, tree int) ([]int, error) {
+	ids := make([]int, 0)
+	level := []int{folder}
+
+	// one query for each level of nesting
+	for len(level) > 0 {
+		next := make([]int, 0)
+		query, args, _ := sqlx.In("SELECT id FROM entity WHERE folder IN (?) AND tree = ? ORDER BY id FOR UPDATE", level, tree)
+		err := tx.Select(&next, query, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, next...)
+		level = next
+	}
+
+	return ids, nil
+}
+
+// lockEntity locks the row of the entity till the end of the transaction
+func lockEntity(tx *sqlx.Tx, id int) error {
+	locked := 0
+	return tx.Get(&locked, "SELECT id FROM entity WHERE id = ? FOR UPDATE", id)
+}
+
+// uniquePath adds the first free number to the name, like "report (2).docx"
+func uniquePath(tx *sqlx.Tx, target string, ftype, tree int) (string, error) {
+	dir, name := path.Dir(target), path.Base(target)
+	ext := path.Ext(name)
+	if ftype == db.FolderRecord || ext == name {
+		ext = ""
+	}
+	base := name[:len(name)-len(ext)]
+
+	for i := 2; ; i++ {
+		next := path.Join(dir, base+" ("+strconv.Itoa(i)+")"+ext)
+
+		used := 0
+		err := tx.Get(&used, "SELECT count(*) FROM entity WHERE path = ? AND tree = ?", next, tree)
+		if err != nil {
+			return "", err
+		}
+		if used == 0 {
+			return next, nil
+		}
+	}
 }
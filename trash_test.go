@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	"github.com/xbsoftware/wfs"
+	db "github.com/xbsoftware/wfs-db"
+)
+
+// tests of trash operations run against a real MySQL database, all its data is removed
+// WFS_TEST_DSN="root:1@(localhost:3306)/files_test" go test -run Trash
+const testDSNVar = "WFS_TEST_DSN"
+
+var testTables = []string{
+	"entity", "entity_edit", "content_blob", "entity_tag", "entity_user", "entity_text",
+	"share_link", "access_log", "comment", "comment_mention", "comment_revision",
+	"favorite", "saved_search", "session", "user",
+}
+
+func setupTrashTest(t *testing.T) (*CurrentUser, http.Handler) {
+	dsn := os.Getenv(testDSNVar)
+	if dsn == "" {
+		t.Skip(testDSNVar + " is not set")
+	}
+	if !strings.Contains(dsn, "?") {
+		dsn += "?multiStatements=true&parseTime=true"
+	}
+
+	var err error
+	conn, err = sqlx.Connect("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	migration(conn)
+
+	for _, table := range testTables {
+		_, err = conn.Exec("TRUNCATE TABLE " + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Config.DataFolder = t.TempDir()
+	driveConfig = wfs.DriveConfig{Verbose: false}
+	driveConfig.Operation = &wfs.OperationConfig{PreventNameCollision: true}
+	drives = make(map[int]wfs.Drive)
+
+	_, err = conn.Exec("INSERT INTO user (id, email, name, avatar) VALUES (1, 'test@example.com', 'Test', '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := getUserRoot(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &CurrentUser{ID: 1, Root: root}
+	user.Drive = getDrive(user)
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, user)))
+		})
+	})
+	addTrashRoutes(r)
+
+	return user, r
+}
+
+// buildTrashTree creates folders and files, some of them share content and have versions
+func buildTrashTree(t *testing.T, user *CurrentUser) {
+	makeTestFolder(t, user, "/", "docs")
+	makeTestFile(t, user, "/docs", "a.txt", "alpha")
+	makeTestFolder(t, user, "/docs", "sub")
+	makeTestFile(t, user, "/docs/sub", "b.txt", "beta")
+	makeTestFile(t, user, "/docs/sub", "c.txt", "alpha")
+	makeTestFile(t, user, "/", "notes.txt", "gamma")
+	makeTestFolder(t, user, "/", "photos")
+	makeTestFile(t, user, "/photos", "p1.txt", "beta")
+	makeTestFolder(t, user, "/", "archive")
+	makeTestFolder(t, user, "/archive", "deep")
+	makeTestFile(t, user, "/archive/deep", "y.txt", "gamma")
+
+	// versions keep references to the old and the new content
+	for _, id := range []string{"/docs/a.txt", "/notes.txt"} {
+		err := user.Drive.Write(id, strings.NewReader("changed "+id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = saveVersion(id, user, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func makeTestFolder(t *testing.T, user *CurrentUser, parent, name string) string {
+	id, err := user.Drive.Make(parent, name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func makeTestFile(t *testing.T, user *CurrentUser, parent, name, content string) string {
+	id, err := user.Drive.Make(parent, name, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = user.Drive.Write(id, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = saveVersion(id, user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func trashRequest(h http.Handler, method, target string, form url.Values) *httptest.ResponseRecorder {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req := httptest.NewRequest(method, target, body)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func trashTestItem(t *testing.T, h http.Handler, id string) {
+	res := trashRequest(h, "POST", "/delete", url.Values{"id": {id}})
+	if res.Code != 200 {
+		t.Fatalf("can't move %s to the trash: %s", id, res.Body.String())
+	}
+}
+
+func getTestEntity(t *testing.T, user *CurrentUser, p string) *db.DBFile {
+	obj := db.DBFile{}
+	err := conn.Get(&obj, "SELECT "+fileFields+" FROM entity WHERE path = ? AND tree = ?", p, user.Root)
+	if err != nil {
+		return nil
+	}
+	return &obj
+}
+
+// trashedPath returns the trash id of the item with the original path
+func trashedPath(t *testing.T, user *CurrentUser, original string) string {
+	paths := make([]string, 0)
+	conn.Select(&paths, "SELECT path FROM entity WHERE folder = -1 AND tree = ?", user.Root)
+	for _, p := range paths {
+		if strings.HasSuffix(p, original) && strings.Count(p, "/") == strings.Count(original, "/")+1 {
+			return p
+		}
+	}
+
+	t.Fatalf("%s is not in the trash", original)
+	return ""
+}
+
+func selectTestPaths(user *CurrentUser, where string) []string {
+	paths := make([]string, 0)
+	conn.Select(&paths, "SELECT path FROM entity WHERE tree = ? AND "+where, user.Root)
+	return paths
+}
+
+// trashRoot returns id of the trashed item, which contains the entity, or 0 for live entities
+func trashRoot(byID map[int]*db.DBFile, e db.DBFile) int {
+	// the depth is limited, so a broken tree can't hang the check
+	for i := 0; i <= len(byID); i++ {
+		if e.Folder == -1 {
+			return e.ID
+		}
+		parent, ok := byID[e.Folder]
+		if !ok {
+			return 0
+		}
+		e = *parent
+	}
+	return 0
+}
+
+// checkTrashIntegrity validates the tree and the references to the content
+func checkTrashIntegrity(t *testing.T, user *CurrentUser) {
+	t.Helper()
+
+	items := make([]db.DBFile, 0)
+	err := conn.Select(&items, "SELECT "+fileFields+" FROM entity WHERE tree = ?", user.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byID := make(map[int]*db.DBFile)
+	for i := range items {
+		byID[items[i].ID] = &items[i]
+	}
+
+	// kids of different trashed copies of a folder share the original paths,
+	// so paths must be unique only inside the live tree and inside each trashed item
+	paths := make(map[string]bool)
+	for _, e := range items {
+		key := e.Path
+		if root := trashRoot(byID, e); root != 0 && root != e.ID {
+			key = strconv.Itoa(root) + ":" + e.Path
+		}
+		if paths[key] {
+			t.Errorf("duplicate path %s", e.Path)
+		}
+		paths[key] = true
+	}
+
+	for _, e := range items {
+		switch e.Folder {
+		case 0:
+			if e.Path != "/" {
+				t.Errorf("unexpected root %s", e.Path)
+			}
+		case -1:
+			if !strings.HasPrefix(e.Path, "./"+strconv.Itoa(e.ID)+"/") || path.Base(e.Path) != e.FileName {
+				t.Errorf("wrong path of the trashed item %s", e.Path)
+			}
+		default:
+			parent, ok := byID[e.Folder]
+			if !ok {
+				t.Errorf("orphaned item %s", e.Path)
+				continue
+			}
+			if parent.Type != db.FolderRecord {
+				t.Errorf("parent of %s is not a folder", e.Path)
+			}
+
+			// children of a trashed folder keep the original path with the "." prefix
+			prefix := parent.Path
+			if parent.Folder == -1 {
+				prefix = "." + deletedPath(parent.Path, parent)
+			} else if prefix == "/" {
+				prefix = ""
+			}
+			if e.Path != prefix+"/"+e.FileName {
+				t.Errorf("path %s doesn't match its parent %s", e.Path, parent.Path)
+			}
+		}
+	}
+
+	orphans := 0
+	err = conn.Get(&orphans, `SELECT count(*) FROM entity_edit WHERE entity_id NOT IN (SELECT id FROM entity)`)
+	if err != nil || orphans != 0 {
+		t.Errorf("history of %d removed items is left, %v", orphans, err)
+	}
+
+	wrong := make([]string, 0)
+	err = conn.Select(&wrong, `SELECT hash FROM content_blob WHERE refs !=
+		(SELECT count(*) FROM entity WHERE content = hash) + (SELECT count(*) FROM entity_edit WHERE content = hash)`)
+	if err != nil || len(wrong) != 0 {
+		t.Errorf("wrong number of references for blobs %v, %v", wrong, err)
+	}
+
+	missing := make([]string, 0)
+	err = conn.Select(&missing, `SELECT content FROM entity WHERE content != '' AND content NOT IN (SELECT hash FROM content_blob)
+		UNION SELECT content FROM entity_edit WHERE content != '' AND content NOT IN (SELECT hash FROM content_blob)`)
+	if err != nil || len(missing) != 0 {
+		t.Errorf("content without blobs %v, %v", missing, err)
+	}
+
+	blobs := make(map[string]bool)
+	hashes := make([]string, 0)
+	conn.Select(&hashes, "SELECT hash FROM content_blob")
+	for _, hash := range hashes {
+		blobs[hash] = true
+		if _, err := os.Stat(filepath.Join(Config.DataFolder, hash)); err != nil {
+			t.Errorf("file of the blob %s is missing", hash)
+		}
+	}
+
+	files, _ := ioutil.ReadDir(Config.DataFolder)
+	for _, f := range files {
+		if !blobs[f.Name()] {
+			t.Errorf("file %s is not used by blobs", f.Name())
+		}
+	}
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	user, h := setupTrashTest(t)
+	buildTrashTree(t, user)
+
+	trashTestItem(t, h, "/docs")
+	if getTestEntity(t, user, "/docs") != nil || getTestEntity(t, user, "./docs/sub/b.txt") == nil {
+		t.Fatal("folder is not moved to the trash")
+	}
+	checkTrashIntegrity(t, user)
+
+	res := trashRequest(h, "PUT", "/delete", url.Values{"id": {trashedPath(t, user, "/docs")}})
+	if res.Code != 200 || getTestEntity(t, user, "/docs/sub/b.txt") == nil {
+		t.Fatalf("folder is not restored: %s", res.Body.String())
+	}
+	checkTrashIntegrity(t, user)
+
+	trashTestItem(t, h, "/docs")
+	res = trashRequest(h, "DELETE", "/delete?"+url.Values{"id": {trashedPath(t, user, "/docs")}}.Encode(), nil)
+	if res.Code != 200 || len(selectTestPaths(user, "path LIKE './docs%'")) != 0 {
+		t.Fatalf("folder is not purged: %s", res.Body.String())
+	}
+	checkTrashIntegrity(t, user)
+}
+
+func TestTrashRestoreConflicts(t *testing.T) {
+	user, h := setupTrashTest(t)
+	buildTrashTree(t, user)
+
+	trashTestItem(t, h, "/docs")
+	makeTestFolder(t, user, "/", "docs")
+	makeTestFile(t, user, "/docs", "a.txt", "other")
+	trashed := trashedPath(t, user, "/docs")
+
+	res := trashRequest(h, "PUT", "/delete", url.Values{"id": {trashed}, "conflict": {"fail"}})
+	if res.Code == 200 || getTestEntity(t, user, trashed) == nil {
+		t.Fatal("restore to the used path must fail")
+	}
+
+	res = trashRequest(h, "PUT", "/delete", url.Values{"id": {trashed}, "conflict": {"merge"}})
+	if res.Code != 200 {
+		t.Fatalf("can't merge folders: %s", res.Body.String())
+	}
+	for _, p := range []string{"/docs/a.txt", "/docs/a (2).txt", "/docs/sub/b.txt", "/docs/sub/c.txt"} {
+		if getTestEntity(t, user, p) == nil {
+			t.Errorf("%s is not restored", p)
+		}
+	}
+	if getTestEntity(t, user, trashed) != nil {
+		t.Error("merged folder is left in the trash")
+	}
+	checkTrashIntegrity(t, user)
+
+	trashTestItem(t, h, "/notes.txt")
+	makeTestFile(t, user, "/", "notes.txt", "new notes")
+	res = trashRequest(h, "PUT", "/delete", url.Values{"id": {trashedPath(t, user, "/notes.txt")}, "conflict": {"overwrite"}})
+	if res.Code != 200 {
+		t.Fatalf("can't overwrite the file: %s", res.Body.String())
+	}
+	if len(selectTestPaths(user, "folder = -1 AND path LIKE '%/notes.txt'")) != 1 {
+		t.Error("overwritten file is not moved to the trash")
+	}
+	checkTrashIntegrity(t, user)
+
+	trashTestItem(t, h, "/photos")
+	makeTestFolder(t, user, "/", "photos")
+	res = trashRequest(h, "PUT", "/delete", url.Values{"id": {trashedPath(t, user, "/photos")}, "conflict": {"rename"}})
+	if res.Code != 200 || getTestEntity(t, user, "/photos (2)/p1.txt") == nil {
+		t.Fatalf("folder is not restored with the new name: %s", res.Body.String())
+	}
+	checkTrashIntegrity(t, user)
+}
+
+func TestTrashBulkOperations(t *testing.T) {
+	user, h := setupTrashTest(t)
+	buildTrashTree(t, user)
+
+	trashTestItem(t, h, "/docs")
+	trashTestItem(t, h, "/notes.txt")
+	trashTestItem(t, h, "/photos")
+
+	ids := []string{trashedPath(t, user, "/docs"), "./0/missing", trashedPath(t, user, "/notes.txt")}
+	res := trashRequest(h, "PUT", "/delete", url.Values{"ids": ids})
+	if res.Code != 200 {
+		t.Fatalf("bulk restore failed: %s", res.Body.String())
+	}
+
+	results := make([]TrashResult, 0)
+	json.Unmarshal(res.Body.Bytes(), &results)
+	if len(results) != 3 || results[0].Error != "" || results[1].Error == "" || results[2].Error != "" {
+		t.Fatalf("wrong results of the bulk restore: %s", res.Body.String())
+	}
+	if getTestEntity(t, user, "/docs/sub/b.txt") == nil || getTestEntity(t, user, "/notes.txt") == nil {
+		t.Fatal("items are not restored")
+	}
+	checkTrashIntegrity(t, user)
+
+	trashTestItem(t, h, "/docs")
+	res = trashRequest(h, "POST", "/trash/empty", url.Values{})
+	if res.Code != 200 || len(selectTestPaths(user, "left(path, 1) = '.'")) != 0 {
+		t.Fatalf("trash is not empty: %s", res.Body.String())
+	}
+	checkTrashIntegrity(t, user)
+}
+
+// concurrent restores and removals of the same item, only one of them can succeed
+func TestTrashSameItemRace(t *testing.T) {
+	user, h := setupTrashTest(t)
+	buildTrashTree(t, user)
+
+	trashTestItem(t, h, "/docs")
+	trashed := trashedPath(t, user, "/docs")
+
+	var done int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if trashRequest(h, "PUT", "/delete", url.Values{"id": {trashed}}).Code == 200 {
+				atomic.AddInt32(&done, 1)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if trashRequest(h, "DELETE", "/delete?"+url.Values{"id": {trashed}}.Encode(), nil).Code == 200 {
+				atomic.AddInt32(&done, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if done != 1 {
+		t.Errorf("%d operations succeeded instead of one", done)
+	}
+	checkTrashIntegrity(t, user)
+}
+
+var testConflicts = []string{RenameConflict, OverwriteConflict, MergeConflict, FailConflict}
+
+func TestTrashConcurrentOperations(t *testing.T) {
+	user, h := setupTrashTest(t)
+	buildTrashTree(t, user)
+
+	// items with the same original path cause conflicts on restore
+	for i := 0; i < 2; i++ {
+		trashTestItem(t, h, "/docs")
+		makeTestFolder(t, user, "/", "docs")
+		makeTestFile(t, user, "/docs", "a.txt", "copy "+strconv.Itoa(i))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for j := 0; j < 40; j++ {
+				randomTrashOperation(h, user, rnd)
+			}
+		}(int64(i + 1))
+	}
+	wg.Wait()
+
+	checkTrashIntegrity(t, user)
+}
+
+// randomTrashOperation runs one of trash operations, failures are expected when items are changed by other requests
+func randomTrashOperation(h http.Handler, user *CurrentUser, rnd *rand.Rand) {
+	pick := func(where string, count int) []string {
+		paths := selectTestPaths(user, where)
+		out := make([]string, 0, count)
+		for i := 0; i < count && len(paths) > 0; i++ {
+			out = append(out, paths[rnd.Intn(len(paths))])
+		}
+		return out
+	}
+	live := "folder > 0 AND left(path, 1) != '.'"
+	trash := "folder = -1"
+
+	switch rnd.Intn(7) {
+	case 0, 1:
+		for _, id := range pick(live, 1) {
+			trashRequest(h, "POST", "/delete", url.Values{"id": {id}})
+		}
+	case 2:
+		for _, id := range pick(trash, 1) {
+			trashRequest(h, "PUT", "/delete", url.Values{"id": {id}, "conflict": {testConflicts[rnd.Intn(len(testConflicts))]}})
+		}
+	case 3:
+		for _, id := range pick(trash, 1) {
+			trashRequest(h, "DELETE", "/delete?"+url.Values{"id": {id}}.Encode(), nil)
+		}
+	case 4:
+		if ids := pick(trash, 3); len(ids) > 0 {
+			trashRequest(h, "PUT", "/delete", url.Values{"ids": ids, "conflict": {testConflicts[rnd.Intn(len(testConflicts))]}})
+		}
+	case 5:
+		if ids := pick(trash, 3); len(ids) > 0 {
+			trashRequest(h, "DELETE", "/delete?"+url.Values{"ids": ids}.Encode(), nil)
+		}
+	case 6:
+		if rnd.Intn(4) == 0 {
+			trashRequest(h, "POST", "/trash/empty", url.Values{})
+		}
+	}
+}